@@ -1,7 +1,7 @@
 /*
 Package 'cfg' provides functions for reading and writing configuration files and their coresponding string values.
 
-	Ignores '#' as comments, ','s denote multiple values.
+	Ignores '#' as comments, as well as lines starting with ';', ','s denote multiple values.
 
 	# Example config file.
 	[section]
@@ -15,27 +15,83 @@ Package 'cfg' provides functions for reading and writing configuration files and
 	key = value1,
 	      value2,
 	      value3
+
+	# Inherits keys of [section2] that it does not set itself.
+	[section3 : section2]
+	key2 = value
+
+	# Quoted names may hold brackets, ':' or '#'.
+	["Server Group [1]"]
+	key = value
+
+Inherited keys are only read through the child section, Set and Save apply to the child's own keys.
 */
 package cfg
 
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"github.com/cmcoffee/go-snuglib/xsync"
 	"io"
+	"io/fs"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// Matched when a configuration file does not exist, use errors.Is to check for it.
+// It is fs.ErrNotExist, so the *fs.PathError returned for a missing file also satisfies os.IsNotExist.
+var ErrConfigNotFound = fs.ErrNotExist
+
+// Returned when saving a Store loaded from a read-only source, such as LoadFS.
+var ErrReadOnly = errors.New("Configuration is read-only.")
+
 type Store struct {
-	file     string
-	mutex    sync.RWMutex
-	cfgStore map[string]map[string][]string
+	file      string
+	mutex     sync.RWMutex
+	flags     xsync.BitFlag
+	max_line  int
+	cfgStore  map[string]map[string][]string
+	regexps   map[[2]string]cachedRegexp
+	raw       map[[2]string][]string
+	normalize func(string) string
+	dirty     map[string]bool
+	parents   map[string]string
+	fsys      fs.FS
+	temp_dir  string
+}
+
+// Compiled pattern cached by GetRegexp, along with the value it was compiled from.
+type cachedRegexp struct {
+	src string
+	re  *regexp.Regexp
 }
 
+// Settings used when parsing configuration.
+type parseOpts struct {
+	flags    uint64
+	max_line int
+}
+
+// Parser options.
+const (
+	opt_BARE_KEYS = 1 << iota
+	opt_REPEAT_KEYS
+	opt_READ_ONLY
+	opt_AUTO_SAVE
+)
+
 const (
 	cfg_HEADER = 1 << iota
 	cfg_KEY
@@ -45,16 +101,109 @@ const (
 
 const empty = ""
 
+// Default limit on the length of a line, raised from the 64KB limit of bufio.Scanner so long values can be read.
+const default_max_line = 1 << 20
+
+// Returns a Scanner for reading lines of up to max bytes, or default_max_line when max is 0.
+func newScanner(r io.Reader, max int) *bufio.Scanner {
+	if max <= 0 {
+		max = default_max_line
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, max)
+	return sc
+}
+
+// Byte order mark some editors place at the start of UTF-8 files.
+const utf8_BOM = "\uFEFF"
+
+// Allows keys without a value, such keys are set to "true".
+// When enabled, a line only continues the value list of the key above it when that line ends with a ','.
+func (s *Store) BareKeys(enable bool) {
+	if enable {
+		s.flags.Set(opt_BARE_KEYS)
+	} else {
+		s.flags.Unset(opt_BARE_KEYS)
+	}
+}
+
+// Allows a key to be repeated within a section, with the values of each line added to the key rather than replacing them.
+// Each line may still hold a ',' separated list, Save writes the combined values back as a single list.
+func (s *Store) RepeatKeys(enable bool) {
+	if enable {
+		s.flags.Set(opt_REPEAT_KEYS)
+	} else {
+		s.flags.Unset(opt_REPEAT_KEYS)
+	}
+}
+
+// Saves the section to file each time Set changes a value, rather than waiting for Save to be called.
+// Auto save is off by default, leaving changes in memory until Save.
+func (s *Store) SetAutoSave(enable bool) {
+	if enable {
+		s.flags.Set(opt_AUTO_SAVE)
+	} else {
+		s.flags.Unset(opt_AUTO_SAVE)
+	}
+}
+
+// Limits the length of a line read when parsing, lines longer than max bytes fail with a ParseError.
+// A max of 0 uses the default limit of 1MB.
+func (s *Store) MaxLineBytes(max int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.max_line = max
+}
+
+// Sets the folder Save writes its temporary file to before it replaces the configuration file.
+// By default the temporary file is written alongside the configuration file, so it can be swapped in with a rename.
+// A folder on another filesystem can't be renamed across, the file is then rewritten in place once the temporary file is complete.
+// Save fails without touching the configuration file if dir can't be written to.
+func (s *Store) TempDir(dir string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.temp_dir = dir
+}
+
+// Sets fn to canonicalize section and key names, such as strings.ToLower for case-insensitive names.
+// fn is applied when parsing, reading and writing, names are normalized before they are looked up or validated.
+// Passing nil leaves names as written, which is the default.
+func (s *Store) NormalizeNames(fn func(name string) string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.normalize = fn
+}
+
+// Returns name after normalizing, mutex must be held by caller.
+func (s *Store) norm(name string) string {
+	if s.normalize == nil {
+		return name
+	}
+	return s.normalize(name)
+}
+
+// Returns section and key after normalizing, mutex must be held by caller.
+func (s *Store) names(section, key string) (string, string) {
+	return s.norm(section), s.norm(key)
+}
+
+// Returns parser settings of Store, mutex must be held by caller.
+func (s *Store) parseOpts() parseOpts {
+	return parseOpts{uint64(s.flags), s.max_line}
+}
+
 // Returns entire line as one string, (Single Get)
 func (s *Store) SGet(section, key string) string {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
+	section, key = s.names(section, key)
+
 	if s.cfgStore == nil {
 		return empty
 	}
 
-	if result, found := s.cfgStore[section][key]; !found {
+	if result, found := s.lookup(section, key); !found {
 		return empty
 	} else {
 		if len(result) == 0 {
@@ -69,11 +218,13 @@ func (s *Store) MGet(section, key string) []string {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
+	section, key = s.names(section, key)
+
 	if s.cfgStore == nil {
 		return []string{}
 	}
 
-	if result, found := s.cfgStore[section][key]; !found {
+	if result, found := s.lookup(section, key); !found {
 		return []string{}
 	} else {
 		if len(result) == 0 {
@@ -83,12 +234,121 @@ func (s *Store) MGet(section, key string) []string {
 	}
 }
 
+// Returns all values of key under section, ok is false and values is nil when the key does not exist.
+func (s *Store) GetOK(section, key string) (values []string, ok bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	section, key = s.names(section, key)
+
+	result, ok := s.lookup(section, key)
+	if !ok {
+		return nil, false
+	}
+	return append([]string(nil), result...), true
+}
+
+// Returns values of key under section, or under the sections it inherits from, mutex must be held by caller.
+func (s *Store) lookup(section, key string) ([]string, bool) {
+	if section, found := s.owner(section, key); found {
+		return s.cfgStore[section][key], true
+	}
+	return nil, false
+}
+
+// Returns the section key is found in, either section or one of the sections it inherits from, mutex must be held by caller.
+func (s *Store) owner(section, key string) (string, bool) {
+	for i := 0; i <= len(s.parents); i++ {
+		if _, found := s.cfgStore[section][key]; found {
+			return section, true
+		}
+		parent, ok := s.parents[section]
+		if !ok {
+			break
+		}
+		section = parent
+	}
+	return empty, false
+}
+
+// Returns values of key as written in the file, with escapes such as \[ left in place, or false if values
+// held no escapes or have been changed since they were read, mutex must be held by caller.
+func (s *Store) rawValues(section, key string, values []string) ([]string, bool) {
+	raw, ok := s.raw[[2]string{section, key}]
+	if !ok || len(raw) != len(values) {
+		return nil, false
+	}
+	for i := range raw {
+		if valueUnescaper.Replace(raw[i]) != values[i] {
+			return nil, false
+		}
+	}
+	return raw, true
+}
+
+// Splits a section header in to the section name and the section it inherits from, ie.. "child : parent".
+// The ':' must have space on both sides, so headers such as [host:8080] remain a single name.
+// Either name may be double quoted, ie.. "\"Server Group 1\" : base", to hold spaces, brackets or ':'.
+func splitSection(header string) (name, parent string) {
+	name, rest := cutSectionName(header)
+	if n := inheritSep(rest); n > -1 && strings.TrimSpace(rest[:n]) == empty {
+		parent, _ = cutSectionName(rest[n+1:])
+	}
+	return
+}
+
+// Returns the section name at the start of input, which may be double quoted, along with the rest of input.
+func cutSectionName(input string) (name, rest string) {
+	input = strings.TrimSpace(input)
+	if strings.HasPrefix(input, `"`) {
+		if q, err := strconv.QuotedPrefix(input); err == nil {
+			name, _ = strconv.Unquote(q)
+			return name, input[len(q):]
+		}
+	}
+	if n := inheritSep(input); n > -1 {
+		return strings.TrimSpace(input[:n]), input[n-1:]
+	}
+	return input, empty
+}
+
+// Returns the position of the first ':' with space on both sides, which separates a section from its parent, or -1.
+func inheritSep(input string) int {
+	for i := 1; i < len(input)-1; i++ {
+		if input[i] == ':' && unicode.IsSpace(rune(input[i-1])) && unicode.IsSpace(rune(input[i+1])) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the contents of a section header line, between its brackets, ok is false if line isn't a section header.
+func sectionHeader(line string) (header string, ok bool) {
+	if n := separators(line, '#'); len(n) > 0 {
+		line = line[:n[0]]
+	}
+	line = strings.TrimSpace(line)
+	if len(line) < 2 || line[0] != '[' || line[len(line)-1] != ']' {
+		return empty, false
+	}
+	return line[1 : len(line)-1], true
+}
+
+// Returns section as written in a section header, quoted when it holds characters that would otherwise be misread.
+// A name with a ':' that could be read as the start of a parent, such as "a :", is quoted as well.
+func quoteSection(section string) string {
+	if section == empty || section != strings.TrimSpace(section) || strings.ContainsAny(section, "[]#;\"\\") || inheritSep(section+" ") > -1 {
+		return strconv.Quote(section)
+	}
+	return section
+}
+
 // Goes through list of sections and keys to make sure they are set.
 func (s *Store) Sanitize(section string, keys []string) (err error) {
 	if s.cfgStore == nil {
 		return fmt.Errorf("[%s] section does not exist, or is not configured.", section)
 	}
-	if _, ok := s.cfgStore[section]; !ok {
+	if !s.Exists(section) {
 		return fmt.Errorf("[%s] section does not exist, or is not configured.", section)
 	}
 	var missing_keys []string
@@ -108,6 +368,8 @@ func (s *Store) Get(section, key string) string {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
+	section, key = s.names(section, key)
+
 	if s.cfgStore == nil {
 		return empty
 	}
@@ -117,7 +379,7 @@ func (s *Store) Get(section, key string) string {
 		found  bool
 	)
 
-	if result, found = s.cfgStore[section][key]; !found {
+	if result, found = s.lookup(section, key); !found {
 		return empty
 	}
 
@@ -130,11 +392,120 @@ func (s *Store) Get(section, key string) string {
 	return result[0]
 }
 
+// Returns the entry at position idx, false if the key does not exist or idx is out of range.
+func (s *Store) GetIndex(section, key string, idx int) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	section, key = s.names(section, key)
+
+	if s.cfgStore == nil {
+		return empty, false
+	}
+
+	result, found := s.lookup(section, key)
+	if !found || idx < 0 || idx >= len(result) {
+		return empty, false
+	}
+
+	return result[idx], true
+}
+
+// Returns all entries of key joined by sep, as returned by MGet, empty if the key does not exist.
+func (s *Store) GetJoined(section, key, sep string) string {
+	return strings.Join(s.MGet(section, key), sep)
+}
+
+// Returns true if the values of key match want, escaping and quoting are ignored on both sides of the comparison.
+func (s *Store) ValueEquals(section, key string, want ...string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	section, key = s.names(section, key)
+
+	result, _ := s.lookup(section, key)
+	return valuesEqual(result, want)
+}
+
+// Compares two lists of values exactly, as stored.
+func sameValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Compares two lists of values, ignoring escaping and quoting.
+func valuesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if unescape(a[i]) != unescape(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Removes surrounding quotes and escape characters from value.
+func unescape(value string) string {
+	if l := len(value); l > 1 && value[0] == '"' && value[l-1] == '"' {
+		value = value[1 : l-1]
+	}
+	if !strings.ContainsRune(value, '\\') {
+		return value
+	}
+	var (
+		out  []rune
+		skip bool
+	)
+	for _, ch := range value {
+		if ch == '\\' && !skip {
+			skip = true
+			continue
+		}
+		skip = false
+		out = append(out, ch)
+	}
+	return string(out)
+}
+
+// Returns the first entry of the first key in keys with a non-empty value, along with the key it came from.
+// Useful for settings that have been renamed, where older names are still accepted.
+func (s *Store) GetFirstNonEmpty(section string, keys ...string) (value string, key string) {
+	for _, key := range keys {
+		if value = s.Get(section, key); value != empty {
+			return value, key
+		}
+	}
+	return empty, empty
+}
+
+// Returns the first entry of key if it matches one of allowed, compared case-insensitively.
+// The entry is returned as written in allowed, otherwise an error listing the allowed values is returned.
+func (s *Store) GetEnum(section, key string, allowed []string) (string, error) {
+	value := s.Get(section, key)
+	for _, v := range allowed {
+		if strings.EqualFold(value, v) {
+			return v, nil
+		}
+	}
+	return empty, fmt.Errorf("[%s] %s: '%s' is not valid, must be one of: %s.", section, key, value, strings.Join(allowed, ", "))
+}
+
 // Get Boolean Value from config.
 func (s *Store) GetBool(section, key string) (output bool) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
+	section, key = s.names(section, key)
+
 	if s.cfgStore == nil {
 		return false
 	}
@@ -144,7 +515,7 @@ func (s *Store) GetBool(section, key string) (output bool) {
 		found  bool
 	)
 
-	if result, found = s.cfgStore[section][key]; !found {
+	if result, found = s.lookup(section, key); !found || len(result) == 0 {
 		return false
 	}
 
@@ -157,15 +528,15 @@ func (s *Store) GetBool(section, key string) (output bool) {
 	default:
 		return false
 	}
-
-	return
 }
 
-// Get Int64 Value from config.
+// Get Int64 Value from config, values prefixed with 0x, 0o, 0b or a leading 0 are read as hexadecimal, octal or binary.
 func (s *Store) GetInt(section, key string) (output int64) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
+	section, key = s.names(section, key)
+
 	if s.cfgStore == nil {
 		return 0
 	}
@@ -175,20 +546,25 @@ func (s *Store) GetInt(section, key string) (output int64) {
 		found  bool
 	)
 
-	if result, found = s.cfgStore[section][key]; !found {
+	if result, found = s.lookup(section, key); !found {
 		return 0
 	}
 
-	output, _ = strconv.ParseInt(result[0], 10, 64)
+	output, err := strconv.ParseInt(result[0], 0, 64)
+	if err != nil {
+		output, _ = strconv.ParseInt(result[0], 10, 64)
+	}
 
 	return
 }
 
-// Get UInt64 Value from config.
+// Get UInt64 Value from config, values prefixed with 0x, 0o, 0b or a leading 0 are read as hexadecimal, octal or binary.
 func (s *Store) GetUint(section, key string) (output uint64) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
+	section, key = s.names(section, key)
+
 	if s.cfgStore == nil {
 		return 0
 	}
@@ -198,11 +574,14 @@ func (s *Store) GetUint(section, key string) (output uint64) {
 		found  bool
 	)
 
-	if result, found = s.cfgStore[section][key]; !found {
+	if result, found = s.lookup(section, key); !found {
 		return 0
 	}
 
-	output, _ = strconv.ParseUint(result[0], 10, 64)
+	output, err := strconv.ParseUint(result[0], 0, 64)
+	if err != nil {
+		output, _ = strconv.ParseUint(result[0], 10, 64)
+	}
 
 	return
 }
@@ -212,6 +591,8 @@ func (s *Store) GetFloat(section, key string) (output float64) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
+	section, key = s.names(section, key)
+
 	if s.cfgStore == nil {
 		return 0.0
 	}
@@ -221,7 +602,7 @@ func (s *Store) GetFloat(section, key string) (output float64) {
 		found  bool
 	)
 
-	if result, found = s.cfgStore[section][key]; !found {
+	if result, found = s.lookup(section, key); !found {
 		return 0.0
 	}
 
@@ -230,6 +611,128 @@ func (s *Store) GetFloat(section, key string) (output float64) {
 	return
 }
 
+// Get URL Value from config, value must be an absolute URL, if schemes are provided the URL must use one of them.
+func (s *Store) GetURL(section, key string, schemes ...string) (*url.URL, error) {
+	value := s.Get(section, key)
+	if value == empty {
+		return nil, fmt.Errorf("[%s] %s: no URL configured.", section, key)
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s: invalid URL '%s': %s", section, key, value, err)
+	}
+	if !u.IsAbs() {
+		return nil, fmt.Errorf("[%s] %s: '%s' is not an absolute URL.", section, key, value)
+	}
+
+	if len(schemes) == 0 {
+		return u, nil
+	}
+	for _, scheme := range schemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("[%s] %s: URL scheme '%s' is not allowed, must be one of: %s.", section, key, u.Scheme, strings.Join(schemes, ", "))
+}
+
+// Get Regexp Value from config, the compiled pattern is cached until the value changes.
+// The pattern is compiled as written in the file, so escapes such as \[ are kept for the regexp to match a literal '['.
+func (s *Store) GetRegexp(section, key string) (*regexp.Regexp, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name, k := s.names(section, key)
+
+	var value string
+	if owner, found := s.owner(name, k); found {
+		if values := s.cfgStore[owner][k]; len(values) > 0 {
+			value = values[0]
+			if raw, ok := s.rawValues(owner, k, values); ok {
+				value = raw[0]
+			}
+		}
+	}
+	if value == empty {
+		return nil, fmt.Errorf("[%s] %s: no pattern configured.", section, key)
+	}
+
+	id := [2]string{name, k}
+	if c, ok := s.regexps[id]; ok && c.src == value {
+		return c.re, nil
+	}
+
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s: invalid pattern '%s': %s", section, key, value, err)
+	}
+	if s.regexps == nil {
+		s.regexps = make(map[[2]string]cachedRegexp)
+	}
+	s.regexps[id] = cachedRegexp{value, re}
+	return re, nil
+}
+
+// Get map Value from config, for keys holding a list of name=value entries such as "labels = env=prod, team=web".
+// An entry without '=', with an empty name or with a name already given returns an error identifying the entry.
+func (s *Store) GetStringMap(section, key string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, entry := range s.MGet(section, key) {
+		name, value, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == empty {
+			return nil, fmt.Errorf("[%s] %s: entry '%s' is not in the form name=value.", section, key, entry)
+		}
+		if _, found := out[name]; found {
+			return nil, fmt.Errorf("[%s] %s: entry '%s' repeats name '%s'.", section, key, entry, name)
+		}
+		out[name] = strings.TrimSpace(value)
+	}
+	return out, nil
+}
+
+// Get map of Int Values from config, for keys such as "limits = cpu=4, mem=8".
+// Values are read the same as GetInt, an entry with a value that isn't a number returns an error identifying the entry.
+func (s *Store) GetIntMap(section, key string) (map[string]int, error) {
+	m, err := s.GetStringMap(section, key)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]int, len(m))
+	for name, value := range m {
+		n, err := strconv.ParseInt(value, 0, strconv.IntSize)
+		if err != nil {
+			if n, err = strconv.ParseInt(value, 10, strconv.IntSize); err != nil {
+				return nil, fmt.Errorf("[%s] %s: entry '%s' has invalid number '%s'.", section, key, name, value)
+			}
+		}
+		out[name] = int(n)
+	}
+	return out, nil
+}
+
+// Get map of Boolean Values from config, for keys such as "features = search=yes, export=no".
+// Values of yes, true, no and false are accepted, any other value returns an error identifying the entry.
+func (s *Store) GetBoolMap(section, key string) (map[string]bool, error) {
+	m, err := s.GetStringMap(section, key)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]bool, len(m))
+	for name, value := range m {
+		switch strings.ToLower(value) {
+		case "yes", "true":
+			out[name] = true
+		case "no", "false":
+			out[name] = false
+		default:
+			return nil, fmt.Errorf("[%s] %s: entry '%s' has invalid boolean '%s', must be yes, true, no or false.", section, key, name, value)
+		}
+	}
+	return out, nil
+}
+
 // Returns array of all sections in config file.
 func (s *Store) Sections() (out []string) {
 	s.mutex.RLock()
@@ -246,11 +749,34 @@ func (s *Store) Sections() (out []string) {
 	return
 }
 
+// Returns a copy of each section named prefix.name, such as [db.primary] and [db.replica] for prefix "db", keyed by name.
+func (s *Store) SubSections(prefix string) map[string]map[string][]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	prefix = s.norm(prefix) + "."
+	out := make(map[string]map[string][]string)
+
+	for section, keys := range s.cfgStore {
+		name := strings.TrimPrefix(section, prefix)
+		if name == section || name == empty {
+			continue
+		}
+		out[name] = make(map[string][]string, len(keys))
+		for key, values := range keys {
+			out[name][key] = append([]string{}, values...)
+		}
+	}
+	return out
+}
+
 // Returns keys of section specified.
 func (s *Store) Keys(section string) (out []string) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
+	section = s.norm(section)
+
 	if v, ok := s.cfgStore[section]; !ok {
 		return []string{empty}
 	} else {
@@ -267,6 +793,11 @@ func (s *Store) Exists(input ...string) (found bool) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
+	input = append([]string{}, input...)
+	for i := range input {
+		input[i] = s.norm(input[i])
+	}
+
 	if s.cfgStore == nil {
 		return false
 	}
@@ -290,34 +821,65 @@ func (s *Store) Exists(input ...string) (found bool) {
 	return
 }
 
+// Returns true if section exists.
+func (s *Store) HasSection(section string) bool {
+	return s.Exists(section)
+}
+
+// Returns true if key is set under section, or under a section it inherits from, matching what Get would find.
+func (s *Store) HasKey(section, key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, found := s.lookup(s.names(section, key))
+	return found
+}
+
 // Unsets a specified key, or specified section.
 // If section is empty, section is removed.
 func (s *Store) Unset(input ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	if s.cfgStore == nil {
-		return
-	}
+	var changed bool
 
 	switch len(input) {
 	case 0:
 		return
 	case 1:
-		keys := s.Keys(input[0])
-		s.mutex.Lock()
-		for _, key := range keys {
-			delete(s.cfgStore[input[0]], key)
+		section := s.norm(input[0])
+		for key := range s.cfgStore[section] {
+			delete(s.cfgStore[section], key)
+			changed = true
 		}
 	default:
-		s.mutex.Lock()
-		delete(s.cfgStore[input[0]], input[1])
+		section, key := s.names(input[0], input[1])
+		if _, ok := s.cfgStore[section][key]; ok {
+			delete(s.cfgStore[section], key)
+			changed = true
+		}
+	}
+	// Removing what isn't there leaves nothing to save.
+	if changed {
+		s.touch(s.norm(input[0]))
 	}
-	s.mutex.Unlock()
 }
 
-// Sets key = values under [section], updates Store and saves to file.
+// Sets key = values under [section], creating the section if needed, Save writes the change to file unless SetAutoSave is enabled.
 func (s *Store) Set(section, key string, value ...interface{}) (err error) {
+	if s.flags.Has(opt_AUTO_SAVE) {
+		// Runs once the lock below is released.
+		defer func() {
+			if err == nil && s.Dirty() {
+				err = s.Save(section)
+			}
+		}()
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+
+	section, key = s.names(section, key)
 	var newValue []string
 
 	if s.cfgStore == nil {
@@ -328,6 +890,11 @@ func (s *Store) Set(section, key string, value ...interface{}) (err error) {
 		newValue = append(newValue, fmt.Sprintf("%v", val))
 	}
 
+	// Nothing to do if value is unchanged, or a missing key is removed.
+	if current, ok := s.cfgStore[section][key]; ok && sameValues(current, newValue) || !ok && len(value) == 0 {
+		return
+	}
+
 	// Create new map if one doesn't exist.
 	if _, ok := s.cfgStore[section]; !ok {
 		s.cfgStore[section] = make(map[string][]string)
@@ -338,24 +905,151 @@ func (s *Store) Set(section, key string, value ...interface{}) (err error) {
 	} else {
 		s.cfgStore[section][key] = newValue
 	}
+	s.touch(section)
 	return
 }
 
-// Creates error output when config file has error.
-func cfgErr(line int) error {
-	return fmt.Errorf("Syntax error found on line %d.", line)
+// Records section as changed since last load or save, mutex must be held by caller.
+func (s *Store) touch(section string) {
+	if s.dirty == nil {
+		s.dirty = make(map[string]bool)
+	}
+	s.dirty[section] = true
 }
 
-// Splits on rune
-func cleanSplit(input string, sepr rune, instances int) (out []string) {
-	var skip, quoted bool
-	var last, q_start, q_end int
+// Returns true if the Store has changes that have not been saved to file.
+func (s *Store) Dirty() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.dirty) > 0
+}
 
-	q_start = -1
-	q_end = -1
-	i_len := len(input)
+// Returns true if both Stores hold the same sections, keys and values, the order of sections and keys is ignored.
+func (s *Store) Equal(other *Store) bool {
+	if s == other {
+		return true
+	}
+	if other == nil {
+		return false
+	}
 
-	//if instances > 0 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	other.mutex.RLock()
+	defer other.mutex.RUnlock()
+
+	if len(s.cfgStore) != len(other.cfgStore) {
+		return false
+	}
+	for section, keys := range s.cfgStore {
+		other_keys, ok := other.cfgStore[section]
+		if !ok || len(keys) != len(other_keys) {
+			return false
+		}
+		for key, values := range keys {
+			other_values, ok := other_keys[key]
+			if !ok || len(values) != len(other_values) {
+				return false
+			}
+			for i := range values {
+				if values[i] != other_values[i] {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// Writes Store to w for display, sections and keys are sorted with values aligned within each section.
+func (s *Store) PrettyPrint(w io.Writer) (err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var sections []string
+	for section := range s.cfgStore {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+
+	for n, section := range sections {
+		if n > 0 {
+			if _, err = io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		if _, err = fmt.Fprintf(w, "[%s]\n", section); err != nil {
+			return err
+		}
+
+		var (
+			keys  []string
+			width int
+		)
+		for key := range s.cfgStore[section] {
+			keys = append(keys, key)
+			if len(key) > width {
+				width = len(key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			values := s.cfgStore[section][key]
+			if len(values) == 0 {
+				values = []string{empty}
+			}
+			for i, v := range values {
+				if i == 0 {
+					_, err = fmt.Fprintf(w, "%-*s = %s\n", width, key, v)
+				} else {
+					_, err = fmt.Fprintf(w, "%-*s   %s\n", width, empty, v)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns Store formatted for display, see PrettyPrint.
+func (s *Store) String() string {
+	var buf bytes.Buffer
+	s.PrettyPrint(&buf)
+	return buf.String()
+}
+
+// Error found while parsing configuration.
+type ParseError struct {
+	File    string // File being parsed, if any.
+	Line    int    // Line the error was found on.
+	Message string // Description of the error.
+}
+
+func (e *ParseError) Error() string {
+	if e.File != empty {
+		return fmt.Sprintf("%s: %s on line %d.", e.File, e.Message, e.Line)
+	}
+	return fmt.Sprintf("%s on line %d.", e.Message, e.Line)
+}
+
+// Creates error output when config file has error.
+func cfgErr(line int) error {
+	return &ParseError{Line: line, Message: "Syntax error found"}
+}
+
+// Splits on rune
+func cleanSplit(input string, sepr rune, instances int) (out []string) {
+	var skip, quoted bool
+	var last, q_start, q_end int
+
+	q_start = -1
+	q_end = -1
+	i_len := len(input)
+
+	//if instances > 0 {
 	//	instances++
 	//}
 
@@ -423,106 +1117,483 @@ func cleanSplit(input string, sepr rune, instances int) (out []string) {
 	return
 }
 
+// Replaces escaped brackets and ';', which allow a value on its own line to begin with '[' or ';',
+// and escaped '#', which allow a value to hold a '#' without starting a comment.
+var valueUnescaper = strings.NewReplacer(`\[`, "[", `\]`, "]", `\#`, "#", `\;`, ";")
+
+// Scans configuration data, calls fn with an empty key and the full header for each section header,
+// and once for each key after all of its values have been read.
+// If errs is not nil, lines with errors are recorded to errs and skipped.
+// Values are passed to fn with escapes removed, raw holds the same values as written.
+func scan(input io.Reader, opts parseOpts, errs *[]error, fn func(line int, section, key string, values, raw []string) error) (err error) {
+	sc := newScanner(input, opts.max_line)
+
+	var (
+		section, key       string
+		values, as_written []string
+		line               int
+		key_line           int
+		pending            bool
+		continued          bool
+	)
+
+	// Hands off the key currently being read.
+	flush := func() error {
+		if !pending {
+			return nil
+		}
+		pending = false
+		return fn(key_line, section, key, values, as_written)
+	}
+
+	// Records parse errors when collecting them, otherwise stops the scan.
+	fail := func(err error) error {
+		if perr, ok := err.(*ParseError); ok && errs != nil {
+			*errs = append(*errs, perr)
+			return nil
+		}
+		return err
+	}
+
+	for sc.Scan() {
+		line++
+		raw := sc.Text()
+		if line == 1 {
+			raw = strings.TrimPrefix(raw, utf8_BOM)
+		}
+		if !utf8.ValidString(raw) {
+			if err = fail(&ParseError{Line: line, Message: "Invalid UTF-8 found"}); err != nil {
+				return err
+			}
+			continue
+		}
+		txt := strings.TrimSpace(cleanSplit(raw, '#', 1)[0])
+		if strings.HasPrefix(txt, ";") {
+			continue
+		}
+
+		if header, ok := sectionHeader(raw); ok {
+			if err = fail(flush()); err != nil {
+				return err
+			}
+			section, _ = splitSection(header)
+			continued = false
+			if err = fail(fn(line, header, empty, nil, nil)); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(txt) == 0 {
+			continue
+		}
+		if section == empty {
+			if err = fail(cfgErr(line)); err != nil {
+				return err
+			}
+			continue
+		}
+		split := cleanSplit(txt, '=', 1)
+		// A line following a trailing ',' continues the value list, any '=' it holds is part of the value.
+		if len(split) == 2 && !(pending && continued) {
+			if err = fail(flush()); err != nil {
+				return err
+			}
+			key = strings.TrimSpace(split[0])
+			txt = strings.TrimSpace(split[1])
+			if key == empty {
+				if err = fail(cfgErr(line)); err != nil {
+					return err
+				}
+				continue
+			}
+			key_line = line
+			values, as_written = nil, nil
+			pending = true
+		} else if opts.flags&opt_BARE_KEYS != 0 && !continued {
+			if err = fail(flush()); err != nil {
+				return err
+			}
+			key = txt
+			key_line = line
+			values = []string{"true"}
+			as_written = values
+			pending = true
+			continue
+		} else if !pending {
+			if err = fail(cfgErr(line)); err != nil {
+				return err
+			}
+			continue
+		}
+		continued = strings.HasSuffix(txt, ",")
+
+		start := 0
+		for _, n := range append(separators(txt, ','), len(txt)) {
+			piece := strings.TrimSpace(txt[start:n])
+			start = n + 1
+			// A quoted empty value is kept, rather than skipped as a blank entry.
+			if piece == `""` {
+				values = append(values, empty)
+				as_written = append(as_written, empty)
+				continue
+			}
+			for _, v := range cleanSplit(piece, ',', -1) {
+				if len(v) > 0 {
+					v = strings.TrimSpace(v)
+					values = append(values, valueUnescaper.Replace(v))
+					as_written = append(as_written, v)
+				}
+			}
+		}
+	}
+	if err = sc.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			limit := opts.max_line
+			if limit <= 0 {
+				limit = default_max_line
+			}
+			return &ParseError{Line: line + 1, Message: fmt.Sprintf("Line exceeds maximum length of %d bytes", limit)}
+		}
+		return err
+	}
+	if pending && continued {
+		if err = fail(&ParseError{Line: key_line, Message: fmt.Sprintf("Unterminated value list for key %s", key)}); err != nil {
+			return err
+		}
+	}
+	return fail(flush())
+}
+
 // Parses the configuration data.
-func (s *Store) config_parser(input io.Reader, overwrite bool) (err error) {
+// If errs is not nil, parsing continues past bad lines with the errors recorded to errs.
+func (s *Store) config_parser(input io.Reader, overwrite bool, errs *[]error) (err error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	sc := bufio.NewScanner(input)
-
 	if s.cfgStore == nil {
 		s.cfgStore = make(map[string]map[string][]string)
 	}
 
-	var section, key string
-	var line int
 	var added_sections []string
 	var added_keys []string
+	var parsed_keys map[string]bool
 
-	for sc.Scan() {
-		line++
-		txt := strings.TrimSpace(cleanSplit(sc.Text(), '#', 1)[0])
+	repeat_keys := s.flags.Has(opt_REPEAT_KEYS)
 
-		write_ok := func(key string) bool {
-			if overwrite {
+	write_ok := func(key string) bool {
+		if overwrite {
+			return true
+		}
+		for _, k := range added_keys {
+			if k == key {
 				return true
 			}
-			for _, k := range added_keys {
-				if k == key {
-					return true
-				}
-			}
-			return false
 		}
+		return false
+	}
 
-		if len(txt) == 0 {
-			continue
+	header_lines := make(map[string]int)
+
+	err = scan(input, s.parseOpts(), errs, func(line int, section, key string, values, raw []string) error {
+		if key == empty {
+			var parent string
+			if section, parent = splitSection(section); parent != empty {
+				if s.parents == nil {
+					s.parents = make(map[string]string)
+				}
+				s.parents[s.norm(section)] = s.norm(parent)
+				header_lines[s.norm(section)] = line
+			}
 		}
-		if txt[0] == '[' && txt[len(txt)-1] == ']' {
+		section = s.norm(section)
+		if key == empty {
 			added_keys = make([]string, 0)
-			section = strings.TrimSuffix(strings.TrimPrefix(txt, "["), "]")
+			parsed_keys = make(map[string]bool)
 			for _, s := range added_sections {
 				if s == section {
-					return fmt.Errorf("Duplicate section [%s] encountered on line %d.", section, line)
+					return &ParseError{Line: line, Message: fmt.Sprintf("Duplicate section [%s] encountered", section)}
 				}
 			}
 			added_sections = append(added_sections, section)
 			if s.cfgStore[section] == nil {
 				s.cfgStore[section] = make(map[string][]string)
 			}
-		} else {
-			if section == empty {
-				return cfgErr(line)
-			}
-			split := cleanSplit(txt, '=', 1)
-			if len(split) == 2 {
-				key = strings.TrimSpace(split[0])
-				txt = strings.TrimSpace(split[1])
-				if _, ok := s.cfgStore[section][key]; !ok {
-					added_keys = append(added_keys, key)
+			return nil
+		}
+		key = s.norm(key)
+		if _, ok := s.cfgStore[section][key]; !ok {
+			added_keys = append(added_keys, key)
+		}
+		if write_ok(key) {
+			id := [2]string{section, key}
+			if repeat_keys && parsed_keys[key] {
+				prev := s.cfgStore[section][key]
+				prev_raw, ok := s.raw[id]
+				if !ok {
+					prev_raw = prev
 				}
-				if write_ok(key) {
-					delete(s.cfgStore[section], key)
+				values = append(append([]string(nil), prev...), values...)
+				raw = append(append([]string(nil), prev_raw...), raw...)
+			}
+			if len(values) > 0 {
+				s.cfgStore[section][key] = values
+			} else {
+				delete(s.cfgStore[section], key)
+			}
+			// Keep values as written only where escapes were removed, for GetRegexp and Save.
+			if len(values) > 0 && !sameValues(values, raw) {
+				if s.raw == nil {
+					s.raw = make(map[[2]string][]string)
 				}
+				s.raw[id] = raw
+			} else {
+				delete(s.raw, id)
 			}
-			if write_ok(key) {
-				for _, v := range cleanSplit(txt, ',', -1) {
-					if len(v) > 0 {
-						s.cfgStore[section][key] = append(s.cfgStore[section][key], strings.TrimSpace(v))
-					}
+		}
+		parsed_keys[key] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sections may not inherit from themselves, directly or through other sections.
+	var children []string
+	for section := range header_lines {
+		children = append(children, section)
+	}
+	sort.Strings(children)
+
+	for _, section := range children {
+		line := header_lines[section]
+		next := s.parents[section]
+		for i := 0; i < len(s.parents) && next != empty; i++ {
+			if next == section {
+				delete(s.parents, section)
+				perr := &ParseError{Line: line, Message: fmt.Sprintf("Inheritance cycle found at section [%s]", section)}
+				if errs == nil {
+					return perr
 				}
+				*errs = append(*errs, perr)
+				break
 			}
+			next = s.parents[next]
+		}
+	}
+	return nil
+}
 
+// Streams each key of a configuration file to fn without loading the file in to a Store.
+// Parsing stops at the first error returned by fn, which is then returned as is.
+func EachEntry(file string, fn func(section, key string, values []string) error) (err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var fn_err error
+
+	err = scan(f, parseOpts{}, nil, func(line int, section, key string, values, _ []string) error {
+		if key == empty {
+			return nil
+		}
+		fn_err = fn(section, key, values)
+		return fn_err
+	})
+	if err != nil {
+		if fn_err != nil {
+			return fn_err
 		}
+		return fileErr(file, err)
 	}
 	return nil
 }
 
+// Reads [section] of file into a map of key to value, without the overhead of a Store.
+// Keys with multiple values only hold their first value, use a Store or EachEntry to read the rest.
+func FlatSection(file, section string) (map[string]string, error) {
+	out := make(map[string]string)
+	err := EachEntry(file, func(s, key string, values []string) error {
+		if s != section {
+			return nil
+		}
+		if len(values) == 0 {
+			delete(out, key)
+		} else {
+			out[key] = values[0]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Returns an empty Store held only in memory, for building configuration before it is written with SaveAs, or for tests.
+// Set changes it in memory and marks it as dirty, Save fails until a file is given by SaveAs.
+func NewStore() *Store {
+	return &Store{cfgStore: make(map[string]map[string][]string)}
+}
+
 // Sets default settings for configuration store, ignores if already set.
 func (s *Store) Defaults(input string) (err error) {
-	return s.config_parser(strings.NewReader(input), false)
+	return s.config_parser(strings.NewReader(input), false, nil)
 }
 
 // Will parse a string, but overwrite existing config.
 func (s *Store) Parse(input string) (err error) {
-	return s.config_parser(strings.NewReader(input), true)
+	return s.config_parser(strings.NewReader(input), true, nil)
 }
 
 // Reads configuration file and returns Store, file must exist even if empty.
 func (s *Store) File(file string) (err error) {
 	s.file = file
+	s.fsys = nil
+	s.flags.Unset(opt_READ_ONLY)
 	f, err := os.Open(file)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	err = s.config_parser(f, true)
+	err = s.config_parser(f, true, nil)
 	if err != nil {
-		return fmt.Errorf("%s: %s", file, err)
+		return fileErr(file, err)
 	}
+	s.mutex.Lock()
+	s.dirty = nil
+	s.mutex.Unlock()
 	return
 }
 
+// Returns the path of the file the Store was loaded from, or empty if it was only parsed from a string.
+func (s *Store) SourceFile() string {
+	return s.file
+}
+
+// Returns the last modified time of the file the Store was loaded from.
+func (s *Store) ModTime() (time.Time, error) {
+	if s.file == empty {
+		return time.Time{}, fmt.Errorf("No file associated with configuration.")
+	}
+	var (
+		fi  fs.FileInfo
+		err error
+	)
+	if s.fsys != nil {
+		fi, err = fs.Stat(s.fsys, s.file)
+	} else {
+		fi, err = os.Stat(s.file)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// Returns the comment lines at the top of file, such as a "#!/usr/bin/env myapp" or "# version: 2" directive,
+// reading stops at the first line that isn't a comment. Save leaves these lines in place.
+func ReadHeaderComments(file string) (comments []string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := newScanner(f, 0)
+	for sc.Scan() {
+		txt := strings.TrimSpace(sc.Text())
+		if len(comments) == 0 {
+			txt = strings.TrimPrefix(txt, utf8_BOM)
+		}
+		if !strings.HasPrefix(txt, "#") && !strings.HasPrefix(txt, ";") {
+			break
+		}
+		comments = append(comments, txt)
+	}
+	return comments, sc.Err()
+}
+
+// Reads configuration from name within fsys, such as an embed.FS holding default settings.
+// The returned Store is read-only, Save and TrimSave return ErrReadOnly.
+func LoadFS(fsys fs.FS, name string) (*Store, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := new(Store)
+	s.file = name
+	s.fsys = fsys
+	s.flags.Set(opt_READ_ONLY)
+	if err = s.config_parser(f, true, nil); err != nil {
+		return nil, fileErr(name, err)
+	}
+	return s, nil
+}
+
+// Reads configuration file and returns Store, skipping any lines that fail to parse.
+// Returns the Store with everything that could be parsed, along with a ParseError for each bad line.
+func LoadTolerant(file string) (*Store, []error) {
+	s := new(Store)
+	s.file = file
+	f, err := os.Open(file)
+	if err != nil {
+		return s, []error{err}
+	}
+	defer f.Close()
+
+	var errs []error
+
+	if err = s.config_parser(f, true, &errs); err != nil {
+		errs = append(errs, err)
+	}
+	for _, err := range errs {
+		if perr, ok := err.(*ParseError); ok {
+			perr.File = file
+		}
+	}
+	return s, errs
+}
+
+// Attaches file name to error.
+func fileErr(file string, err error) error {
+	if perr, ok := err.(*ParseError); ok {
+		perr.File = file
+		return perr
+	}
+	return fmt.Errorf("%s: %w", file, err)
+}
+
+// Reads configuration file and returns Store, any keys not found in the file are set from defaults.
+// Defaults are only applied to the Store in memory, the file is left untouched until saved.
+func LoadWithDefaults(file string, defaults map[string]map[string][]string) (*Store, error) {
+	s := new(Store)
+	if err := s.File(file); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for section, keys := range defaults {
+		section = s.norm(section)
+		if s.cfgStore[section] == nil {
+			s.cfgStore[section] = make(map[string][]string)
+		}
+		for key, values := range keys {
+			key = s.norm(key)
+			if _, ok := s.cfgStore[section][key]; ok || len(values) == 0 {
+				continue
+			}
+			s.cfgStore[section][key] = append([]string{}, values...)
+		}
+	}
+	return s, nil
+}
+
 // TrimSave is similar to Save, however it will trim unusued keys.
 func (s *Store) TrimSave(sections ...string) error {
 	return s.save(true, sections...)
@@ -533,7 +1604,151 @@ func (s *Store) Save(sections ...string) error {
 	return s.save(false, sections...)
 }
 
-func (s *Store) save(clear_unused_keys bool, sections ...string) error {
+// Saves all sections to file, which Save and TrimSave write to from then on.
+// If file already exists, it is updated as Save would, keeping its comments and any sections the Store doesn't hold.
+func (s *Store) SaveAs(file string) error {
+	s.mutex.Lock()
+	s.file = file
+	s.fsys = nil
+	s.mutex.Unlock()
+	s.flags.Unset(opt_READ_ONLY)
+	return s.save(false)
+}
+
+// Serializes AppendFile and CompareAndSet calls within the process.
+var append_lock sync.Mutex
+
+// Appends value to key under [section] in file, creating the file if needed.
+// The file is locked and re-read before appending, as with CompareAndSet, so callers in this or other processes
+// don't overwrite each other's values. Processes that write file without AppendFile or CompareAndSet aren't held off.
+func AppendFile(file, section, key, value string) error {
+	append_lock.Lock()
+	defer append_lock.Unlock()
+
+	unlock, err := lockFile(file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var s Store
+	if err := s.File(file); err != nil && !errors.Is(err, ErrConfigNotFound) {
+		return err
+	}
+
+	var values []interface{}
+	for _, v := range s.MGet(section, key) {
+		values = append(values, v)
+	}
+	values = append(values, value)
+
+	if err := s.Set(section, key, values...); err != nil {
+		return err
+	}
+	return s.Save(section)
+}
+
+// How long AppendFile and CompareAndSet wait for another process to release the lock on a file.
+const lock_timeout = 10 * time.Second
+
+// Takes a lock on file shared with other processes, by creating file.lock, the returned function releases it.
+func lockFile(file string) (func(), error) {
+	lock := file + ".lock"
+	deadline := time.Now().Add(lock_timeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			// File is yet to be created, along with its folder.
+			if err = os.MkdirAll(filepath.Dir(lock), 0755); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for lock %s, remove it if no other process is using %s.", lock, file)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Sets key under section to values and saves it, only if the file still holds expected for key, allowing a
+// read-modify-write to be shared between processes. The file is locked and re-read, if key no longer matches
+// expected nothing is written and false is returned, the caller should reload the file and try again.
+// A key that doesn't exist matches an empty expected. Other keys are saved as they are in the file, not as held by s.
+func (s *Store) CompareAndSet(section, key string, expected, values []string) (bool, error) {
+	if s.flags.Has(opt_READ_ONLY) {
+		return false, ErrReadOnly
+	}
+	if s.file == empty {
+		return false, fmt.Errorf("No file specified for write operation.")
+	}
+
+	append_lock.Lock()
+	defer append_lock.Unlock()
+
+	unlock, err := lockFile(s.file)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	s.mutex.RLock()
+	current := &Store{
+		flags:     xsync.BitFlag(uint64(s.flags) &^ opt_AUTO_SAVE),
+		max_line:  s.max_line,
+		normalize: s.normalize,
+		temp_dir:  s.temp_dir,
+	}
+	s.mutex.RUnlock()
+
+	if err = current.File(s.file); err != nil && !errors.Is(err, ErrConfigNotFound) {
+		return false, err
+	}
+	if found, _ := current.GetOK(section, key); !valuesEqual(found, expected) {
+		return false, nil
+	}
+
+	var set []interface{}
+	for _, v := range values {
+		set = append(set, v)
+	}
+	if err = current.Set(section, key, set...); err != nil {
+		return false, err
+	}
+	if err = current.Save(section); err != nil {
+		return false, err
+	}
+
+	// Keep s in step with the file, without marking the section as changed.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	section, key = s.names(section, key)
+	if s.cfgStore == nil {
+		s.cfgStore = make(map[string]map[string][]string)
+	}
+	if s.cfgStore[section] == nil {
+		s.cfgStore[section] = make(map[string][]string)
+	}
+	if len(values) == 0 {
+		delete(s.cfgStore[section], key)
+	} else {
+		s.cfgStore[section][key] = append([]string(nil), values...)
+	}
+	return true, nil
+}
+
+func (s *Store) save(clear_unused_keys bool, sections ...string) (err error) {
+
+	if s.flags.Has(opt_READ_ONLY) {
+		return ErrReadOnly
+	}
 
 	if s.file == empty {
 		return fmt.Errorf("No file specified for write operation.")
@@ -546,9 +1761,29 @@ func (s *Store) save(clear_unused_keys bool, sections ...string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	sections = append([]string{}, sections...)
+	for i := range sections {
+		sections[i] = s.norm(sections[i])
+	}
+
+	// Saved sections no longer hold unsaved changes.
+	defer func() {
+		if err == nil {
+			for _, section := range sections {
+				delete(s.dirty, section)
+			}
+		}
+	}()
+
 	f, err := os.Open(s.file)
 	if err != nil {
 		if os.IsNotExist(err) {
+			// First save of a new configuration, create the file along with any missing folders.
+			if dir := filepath.Dir(s.file); dir != "." {
+				if err = os.MkdirAll(dir, 0755); err != nil {
+					return err
+				}
+			}
 			f, err = os.Create(s.file)
 			if err != nil {
 				return err
@@ -558,6 +1793,8 @@ func (s *Store) save(clear_unused_keys bool, sections ...string) error {
 		}
 	}
 
+	max_line := s.max_line
+
 	// interface for copying file content to ram and back to disk.
 	type source interface {
 		Seek(offset int64, whence int) (int64, error)
@@ -571,7 +1808,7 @@ func (s *Store) save(clear_unused_keys bool, sections ...string) error {
 			return err
 		}
 
-		s := bufio.NewScanner(src)
+		s := newScanner(src, max_line)
 		var line int
 
 		for line < start {
@@ -586,13 +1823,15 @@ func (s *Store) save(clear_unused_keys bool, sections ...string) error {
 				return err
 			}
 		}
-		return nil
+		return s.Err()
 	}
 
+	s_norm := s.norm
+
 	// cfgSeek returns first half and bottom half of file, excluding the key = value.
 	cfgSeek := func(section string, f source) (upper int, lower int) {
 		f.Seek(0, 0)
-		s := bufio.NewScanner(f)
+		s := newScanner(f, max_line)
 
 		var line int
 
@@ -603,13 +1842,13 @@ func (s *Store) save(clear_unused_keys bool, sections ...string) error {
 			b := strings.TrimSpace(s.Text())
 			l := len(b)
 
-			if l > 0 && b[0] == '#' || l == 0 {
+			if l > 0 && (b[0] == '#' || b[0] == ';') || l == 0 {
 				continue
 			}
 
 			// Record the beginning of the next section
-			if strings.HasPrefix(b, "[") {
-				if strings.HasPrefix(b, "["+section+"]") {
+			if header, ok := sectionHeader(b); ok {
+				if name, _ := splitSection(header); s_norm(name) == section {
 					upper = line - 1
 					continue
 				} else if upper > -1 {
@@ -625,8 +1864,9 @@ func (s *Store) save(clear_unused_keys bool, sections ...string) error {
 	}
 
 	// Stores Key Value pairs
-	storeKV := func(dst *bytes.Buffer, k string, keymap map[string][]string) (err error) {
-		v := keymap[k]
+	storeKV := func(dst *bytes.Buffer, section, k string) (err error) {
+		v := s.cfgStore[section][k]
+		raw, escaped := s.rawValues(section, k, v)
 		if len(v) == 0 && clear_unused_keys {
 			return nil
 		}
@@ -645,8 +1885,26 @@ func (s *Store) save(clear_unused_keys bool, sections ...string) error {
 			return
 		}
 		for n, txt := range v {
-			if strings.Contains(txt, ",") {
+			if escaped {
+				// Unchanged since read, write the value as it was written, escapes included.
+				txt = raw[n]
+				if txt == empty {
+					txt = `""`
+				} else if len(separators(txt, ',')) > 0 || len(separators(txt, '#')) > 0 || strings.HasPrefix(txt, "[") || strings.HasPrefix(txt, ";") {
+					txt = `"` + txt + `"`
+				}
+			} else if txt == empty {
+				// Quote empty values so they aren't lost when read back.
+				txt = `""`
+			} else if strings.Contains(txt, ",") {
 				txt = strconv.Quote(txt)
+			} else {
+				if n > 0 && (strings.HasPrefix(txt, "[") || strings.HasPrefix(txt, ";")) {
+					// Escape bracket or ';' starting a line, so value isn't mistaken for a section header or comment.
+					txt = "\\" + txt
+				}
+				// Escape '#' so value isn't mistaken for a comment.
+				txt = strings.ReplaceAll(txt, "#", `\#`)
 			}
 			if n > 0 {
 				str = fmt.Sprintf("%s%s", spacer, txt)
@@ -674,6 +1932,13 @@ func (s *Store) save(clear_unused_keys bool, sections ...string) error {
 	}
 	f.Close()
 
+	original := append([]byte{}, tmp_dst.Bytes()...)
+
+	// Drop any byte order mark, so the first section header can be found.
+	if bytes.HasPrefix(tmp_dst.Bytes(), []byte(utf8_BOM)) {
+		tmp_dst.Next(len(utf8_BOM))
+	}
+
 	var src_buf []byte
 
 	for _, section := range sections {
@@ -707,46 +1972,86 @@ func (s *Store) save(clear_unused_keys bool, sections ...string) error {
 				return err
 			}
 
-			var used_keys []string
+			var (
+				used_keys []string
+				sec_out   bytes.Buffer
+				insert_at int
+				continued bool
+			)
 
-			if _, err = tmp_dst.WriteString("[" + section + "]\n"); err != nil {
+			header := quoteSection(section)
+			if parent, ok := s.parents[section]; ok {
+				header = header + " : " + quoteSection(parent)
+			}
+			if _, err = tmp_dst.WriteString("[" + header + "]\n"); err != nil {
 				return err
 			}
 
-			sc := bufio.NewScanner(&sec_buf)
+			sc := newScanner(&sec_buf, max_line)
 			for sc.Scan() {
 				raw := sc.Text()
 				txt := strings.TrimSpace(raw)
 				if len(txt) == 0 {
-					_, err = tmp_dst.WriteString("\n")
+					_, err = sec_out.WriteString("\n")
 					if err != nil {
 						return err
 					}
 					continue
 				}
 				switch txt[0] {
-				case '#':
-					_, err = tmp_dst.WriteString(raw + "\n")
+				case '#', ';':
+					_, err = sec_out.WriteString(raw + "\n")
 					if err != nil {
 						return err
 					}
 				case '[':
-					if txt[len(txt)-1] == ']' {
-						if txt == "["+section+"]" {
+					if header, ok := sectionHeader(txt); ok {
+						if name, _ := splitSection(header); s.norm(name) == section {
 							continue
 						}
 					}
 				default:
-					if strings.ContainsRune(txt, '=') {
-						key := strings.TrimSpace(strings.Split(txt, "=")[0])
-						if err = storeKV(tmp_dst, key, s.cfgStore[section]); err != nil {
-							return err
+					var (
+						key  string
+						bare bool
+					)
+					if !continued {
+						if strings.ContainsRune(txt, '=') {
+							key = s.norm(strings.TrimSpace(strings.Split(txt, "=")[0]))
+						} else if s.flags.Has(opt_BARE_KEYS) {
+							key, bare = s.norm(strings.TrimSpace(cleanSplit(txt, '#', 1)[0])), true
 						}
-						used_keys = append(used_keys, key)
 					}
+					continued = strings.HasSuffix(txt, ",")
+					// A repeated key was written in full at its first line, drop the repeats.
+					for _, k := range used_keys {
+						if k == key {
+							key = empty
+							break
+						}
+					}
+					if key == empty {
+						continue
+					}
+					if v := s.cfgStore[section][key]; bare && len(v) == 1 && v[0] == "true" {
+						// Keep a bare key as written while it is still set.
+						_, err = sec_out.WriteString(raw + "\n")
+					} else {
+						err = storeKV(&sec_out, section, key)
+					}
+					if err != nil {
+						return err
+					}
+					used_keys = append(used_keys, key)
+					insert_at = sec_out.Len()
 				}
 			}
 
+			// New keys are placed after the last key of the section, ahead of any trailing comments or blank lines.
+			if _, err = tmp_dst.Write(sec_out.Bytes()[:insert_at]); err != nil {
+				return err
+			}
+
 			var all_keys []string
 
 			for key := range s.cfgStore[section] {
@@ -761,10 +2066,14 @@ func (s *Store) save(clear_unused_keys bool, sections ...string) error {
 						continue outter_loop
 					}
 				}
-				if err = storeKV(tmp_dst, k, s.cfgStore[section]); err != nil {
+				if err = storeKV(tmp_dst, section, k); err != nil {
 					return err
 				}
 			}
+
+			if _, err = tmp_dst.Write(sec_out.Bytes()[insert_at:]); err != nil {
+				return err
+			}
 			//if _, err = tmp_dst.WriteString("\n"); err != nil { return err }
 		}
 		if err = copyFile(tmp_src, tmp_dst, tail, -1); err != nil {
@@ -772,21 +2081,67 @@ func (s *Store) save(clear_unused_keys bool, sections ...string) error {
 		}
 	}
 
-	destfile, err := os.OpenFile(s.file, os.O_RDWR|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
+	// Leave file untouched if nothing has changed.
+	if bytes.Equal(original, tmp_dst.Bytes()) {
+		return nil
 	}
-	defer destfile.Close()
 
-	_, err = io.Copy(destfile, tmp_dst)
-	if err != nil {
-		return err
+	return replaceFile(s.file, s.temp_dir, tmp_dst.Bytes())
+}
+
+// Replaces contents of file with data, data is written to a temporary file that is then renamed over file,
+// so file is never left partially written and the temporary file is removed on failure.
+// The temporary file is written to temp_dir when set, otherwise to the folder holding file.
+func replaceFile(file, temp_dir string, data []byte) (err error) {
+	if target, err := filepath.EvalSymlinks(file); err == nil {
+		file = target
+	}
+
+	mode := fs.FileMode(0600)
+	if fi, err := os.Stat(file); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	dir, name := filepath.Split(file)
+	if temp_dir != empty {
+		dir = temp_dir
+	}
+	if dir == empty {
+		dir = "."
 	}
 
-	err = destfile.Sync()
+	tmp, err := os.CreateTemp(dir, "."+name+".tmp*")
 	if err != nil {
-		return err
+		return fmt.Errorf("Unable to create temporary file: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
 
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), file); err != nil {
+		if !errors.Is(err, syscall.EXDEV) || temp_dir == empty {
+			return err
+		}
+		// Temporary folder is on another filesystem, rewrite the file in place instead.
+		if err = os.WriteFile(file, data, mode); err != nil {
+			return err
+		}
+		os.Remove(tmp.Name())
+	}
 	return nil
 }
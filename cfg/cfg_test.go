@@ -0,0 +1,1073 @@
+package cfg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Writes data to a config file in a temporary folder, returning its path.
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "test.cfg")
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// Loads file in to a new Store.
+func loadConfig(t *testing.T, file string) *Store {
+	t.Helper()
+	s := new(Store)
+	if err := s.File(file); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSetUnchanged(t *testing.T) {
+	file := writeConfig(t, "[main]\nkey = x\n")
+	s := loadConfig(t, file)
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(file, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set("main", "key", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Dirty() {
+		t.Error("Set of an unchanged value marked the Store dirty.")
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(old) {
+		t.Errorf("mtime changed from %s to %s by a no-op Set.", old, fi.ModTime())
+	}
+}
+
+func TestSetExactCompare(t *testing.T) {
+	for _, value := range []string{`"x"`, `x\`} {
+		s := loadConfig(t, writeConfig(t, "[main]\nkey = x\n"))
+		if err := s.Set("main", "key", value); err != nil {
+			t.Fatal(err)
+		}
+		if !s.Dirty() {
+			t.Errorf("Set(%q) over x was treated as unchanged.", value)
+		}
+		if got := s.Get("main", "key"); got != value {
+			t.Errorf("Get returned %q after Set(%q).", got, value)
+		}
+	}
+}
+
+func TestCommentMarkers(t *testing.T) {
+	s := loadConfig(t, writeConfig(t, "# hash comment\n; semicolon comment\n[main]\nkey = a, # trailing comment\n      b\n; between values\n# also between\nother = c\n"))
+	if got := s.MGet("main", "key"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("key = %q, want [a b].", got)
+	}
+	if got := s.Get("main", "other"); got != "c" {
+		t.Errorf("other = %q, want c.", got)
+	}
+}
+
+func TestCommentMarkersRoundTrip(t *testing.T) {
+	file := writeConfig(t, "; header\n[main]\n# keep\nkey = x\n")
+	s := loadConfig(t, file)
+
+	want := []string{"a", ";x", "#y", "[z]", "b;c#d"}
+	var values []interface{}
+	for _, v := range want {
+		values = append(values, v)
+	}
+	if err := s.Set("main", "key", values...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := loadConfig(t, file).MGet("main", "key")
+	if len(got) != len(want) {
+		t.Fatalf("read back %q, want %q.", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("value %d read back as %q, want %q.", i, got[i], want[i])
+		}
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, comment := range []string{"; header", "# keep"} {
+		if !strings.Contains(string(data), comment) {
+			t.Errorf("comment %q was lost on Save:\n%s", comment, data)
+		}
+	}
+}
+
+func TestConfigNotFound(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "missing.cfg")
+
+	var s Store
+	err := s.File(file)
+	if !errors.Is(err, ErrConfigNotFound) {
+		t.Errorf("errors.Is(%v, ErrConfigNotFound) is false.", err)
+	}
+	if !os.IsNotExist(err) {
+		t.Errorf("os.IsNotExist(%v) is false.", err)
+	}
+
+	err = s.File(writeConfig(t, "no section\n"))
+	if err == nil || errors.Is(err, ErrConfigNotFound) {
+		t.Errorf("parse error %v matches ErrConfigNotFound.", err)
+	}
+
+	// Read errors keep their cause along with the file name.
+	var perr *os.PathError
+	dir := t.TempDir()
+	err = s.File(dir)
+	if !errors.As(err, &perr) || !strings.HasPrefix(fmt.Sprint(err), dir+": ") {
+		t.Errorf("File of a folder returned %v, want it to wrap the read error.", err)
+	}
+	err = EachEntry(dir, func(string, string, []string) error { return nil })
+	if !errors.As(err, &perr) {
+		t.Errorf("EachEntry of a folder returned %v, want it to wrap the read error.", err)
+	}
+}
+
+// Appends values to a file when run as a child process by TestAppendFileProcesses.
+func TestAppendFileHelper(t *testing.T) {
+	file, prefix := os.Getenv("CFG_APPEND_FILE"), os.Getenv("CFG_APPEND_PREFIX")
+	if file == "" {
+		t.Skip("Only run by TestAppendFileProcesses.")
+	}
+	for i := 0; i < 10; i++ {
+		if err := AppendFile(file, "main", "list", fmt.Sprintf("%s%d", prefix, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAppendFileProcesses(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sub", "shared.cfg")
+
+	var cmds []*exec.Cmd
+	for _, prefix := range []string{"a", "b", "c", "d"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestAppendFileHelper$")
+		cmd.Env = append(os.Environ(), "CFG_APPEND_FILE="+file, "CFG_APPEND_PREFIX="+prefix)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := loadConfig(t, file).MGet("main", "list"); len(got) != 40 {
+		t.Errorf("file holds %d values, want 40: %q", len(got), got)
+	}
+	if _, err := os.Stat(file + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file was left behind.")
+	}
+}
+
+func TestTempDirCrossDevice(t *testing.T) {
+	file := writeConfig(t, "[main]\nkey = 1\n")
+
+	// Needs a folder on another filesystem, which /dev/shm usually is.
+	temp, err := os.MkdirTemp("/dev/shm", "cfg-test")
+	if err != nil {
+		t.Skip("No /dev/shm to use as a second filesystem.")
+	}
+	defer os.RemoveAll(temp)
+	probe := filepath.Join(temp, "probe")
+	if err = os.WriteFile(probe, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(probe, file+".probe")
+	os.Remove(probe)
+	os.Remove(file + ".probe")
+	if !errors.Is(err, syscall.EXDEV) {
+		t.Skip("/dev/shm is on the same filesystem as the temporary folder.")
+	}
+
+	s := loadConfig(t, file)
+	s.TempDir(temp)
+	if err = s.Set("main", "key", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadConfig(t, file).Get("main", "key"); got != "2" {
+		t.Errorf("key = %q after Save, want 2.", got)
+	}
+	if left, _ := os.ReadDir(temp); len(left) != 0 {
+		t.Errorf("temporary file left in %s.", temp)
+	}
+}
+
+func TestTempDirUnwritable(t *testing.T) {
+	file := writeConfig(t, "[main]\nkey = 1\n")
+	s := loadConfig(t, file)
+	s.TempDir(filepath.Join(t.TempDir(), "missing"))
+	if err := s.Set("main", "key", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err == nil {
+		t.Error("Save succeeded with a temporary folder that doesn't exist.")
+	}
+	if got := loadConfig(t, file).Get("main", "key"); got != "1" {
+		t.Errorf("key = %q after a failed Save, want 1.", got)
+	}
+}
+
+func TestAutoSave(t *testing.T) {
+	file := writeConfig(t, "[main]\nkey = x\nold = y\n")
+	s := loadConfig(t, file)
+
+	read := func() string {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	orig := read()
+
+	if err := s.Set("main", "key", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	s.Unset("main", "old")
+	if data := read(); data != orig {
+		t.Errorf("file written before Save with auto save off:\n%s", data)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if data := read(); !strings.Contains(data, "changed") {
+		t.Errorf("Save did not write pending changes:\n%s", data)
+	}
+
+	s.SetAutoSave(true)
+	if err := s.Set("main", "key", "saved"); err != nil {
+		t.Fatal(err)
+	}
+	if data := read(); !strings.Contains(data, "saved") {
+		t.Errorf("Set with auto save on did not write the file:\n%s", data)
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	file := writeConfig(t, "[main]\ncounter = 1\nother = a\n")
+	s := loadConfig(t, file)
+
+	// Another process changes the file after s was read.
+	other := loadConfig(t, file)
+	if err := other.Set("main", "counter", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Set("main", "other", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := s.CompareAndSet("main", "counter", s.MGet("main", "counter"), []string{"10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("CompareAndSet succeeded against a stale value.")
+	}
+	if got := loadConfig(t, file).Get("main", "counter"); got != "2" {
+		t.Errorf("failed CompareAndSet wrote counter = %q.", got)
+	}
+
+	// Reload and retry.
+	s = loadConfig(t, file)
+	ok, err = s.CompareAndSet("main", "counter", s.MGet("main", "counter"), []string{"3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("CompareAndSet failed against the current value.")
+	}
+	saved := loadConfig(t, file)
+	if got := saved.Get("main", "counter"); got != "3" {
+		t.Errorf("file holds counter = %q, want 3.", got)
+	}
+	if got := saved.Get("main", "other"); got != "b" {
+		t.Errorf("CompareAndSet changed other to %q.", got)
+	}
+	if got := s.Get("main", "counter"); got != "3" || s.Dirty() {
+		t.Errorf("Store holds counter = %q, dirty = %v, want 3 and clean.", got, s.Dirty())
+	}
+	if _, err := os.Stat(file + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
+
+func TestBareKeys(t *testing.T) {
+	const data = "[main]\nverbose\nname = example\ndebug\nlist = a,\n  b\n"
+
+	if err := new(Store).Parse(data); err == nil {
+		t.Error("bare key accepted without BareKeys.")
+	}
+
+	s := new(Store)
+	s.BareKeys(true)
+	if err := s.Parse(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"verbose", "debug"} {
+		if !s.GetBool("main", key) {
+			t.Errorf("GetBool(%q) = false for a bare key.", key)
+		}
+	}
+	if got := s.Get("main", "name"); got != "example" {
+		t.Errorf("name = %q, want example.", got)
+	}
+	if got := s.MGet("main", "list"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("list = %q, want [a b].", got)
+	}
+	if s.GetBool("main", "missing") {
+		t.Error("GetBool returned true for a missing key.")
+	}
+}
+
+func TestGetIntPrefixes(t *testing.T) {
+	s := new(Store)
+	err := s.Parse("[main]\nmode = 0755\nmask = 0xFF\nbits = 0b101\nmodern = 0o644\ncount = 42\nnegative = -0x10\nbad = abc\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key  string
+		want int64
+	}{
+		{"mode", 0755},
+		{"mask", 0xFF},
+		{"bits", 5},
+		{"modern", 0644},
+		{"count", 42},
+		{"negative", -16},
+		{"bad", 0},
+		{"missing", 0},
+	}
+	for _, test := range tests {
+		if got := s.GetInt("main", test.key); got != test.want {
+			t.Errorf("GetInt(%q) = %d, want %d.", test.key, got, test.want)
+		}
+	}
+
+	if got := os.FileMode(s.GetUint("main", "mode")); got != 0755 {
+		t.Errorf("GetUint(mode) = %o, want 755.", got)
+	}
+	if got := s.GetUint("main", "mask"); got != 0xFF {
+		t.Errorf("GetUint(mask) = %#x, want 0xff.", got)
+	}
+	if got := s.GetUint("main", "negative"); got != 0 {
+		t.Errorf("GetUint(negative) = %d, want 0.", got)
+	}
+}
+
+func TestSaveNewKeyPosition(t *testing.T) {
+	file := writeConfig(t, "[first]\na = 1\nb = 2\n\n# Second section.\n[second]\nc = 3\nd = 4\n# Trailing comment.\n")
+	s := loadConfig(t, file)
+
+	if err := s.Set("first", "z", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("second", "e", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[first]\na = 1\nb = 2\nz = new\n\n# Second section.\n[second]\nc = 3\nd = 4\ne = 5\n# Trailing comment.\n"
+	if string(data) != want {
+		t.Errorf("Save wrote:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	for _, data := range []string{
+		"\uFEFF[main]\nkey = value\n",
+		"\uFEFF# Comment.\n[main]\nkey = value\n",
+	} {
+		s := loadConfig(t, writeConfig(t, data))
+		if got := s.Sections(); len(got) != 1 || got[0] != "main" {
+			t.Errorf("%q: sections = %q, want [main].", data, got)
+		}
+		if got := s.Get("main", "key"); got != "value" {
+			t.Errorf("%q: key = %q, want value.", data, got)
+		}
+	}
+
+	file := writeConfig(t, "\uFEFF# version: 2\n[main]\n")
+	comments, err := ReadHeaderComments(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 1 || comments[0] != "# version: 2" {
+		t.Errorf("header comments = %q, want [# version: 2].", comments)
+	}
+}
+
+func TestSortedNames(t *testing.T) {
+	s := new(Store)
+	if err := s.Parse("[zeta]\nb = 1\n[alpha]\nz = 1\nm = 2\na = 3\n[mid]\nk = 1\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	sections := fmt.Sprint(s.Sections())
+	keys := fmt.Sprint(s.Keys("alpha"))
+	if sections != "[alpha mid zeta]" {
+		t.Errorf("Sections = %s, want [alpha mid zeta].", sections)
+	}
+	if keys != "[a m z]" {
+		t.Errorf("Keys = %s, want [a m z].", keys)
+	}
+
+	// Map iteration order varies between calls, output must not.
+	for i := 0; i < 50; i++ {
+		if got := fmt.Sprint(s.Sections()); got != sections {
+			t.Fatalf("Sections changed from %s to %s.", sections, got)
+		}
+		if got := fmt.Sprint(s.Keys("alpha")); got != keys {
+			t.Fatalf("Keys changed from %s to %s.", keys, got)
+		}
+	}
+}
+
+func TestReplaceFileFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	// A non-empty folder in place of the file fails the rename, after the temporary file is written.
+	target := filepath.Join(dir, "test.cfg")
+	if err := os.MkdirAll(filepath.Join(target, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceFile(target, empty, []byte("[main]\n")); err == nil {
+		t.Fatal("replaceFile succeeded over a folder.")
+	}
+
+	file := filepath.Join(dir, "keep.cfg")
+	if err := os.WriteFile(file, []byte("[main]\nkey = x\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceFile(file, empty, []byte("[main]\nkey = y\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp") {
+			t.Errorf("temporary file %s left behind.", e.Name())
+		}
+	}
+	if data, _ := os.ReadFile(file); string(data) != "[main]\nkey = y\n" {
+		t.Errorf("file holds %q after replace.", data)
+	}
+}
+
+func TestRepeatKeysSave(t *testing.T) {
+	file := writeConfig(t, "[main]\nheader = X\nother = 1\nheader = Y,\n  Z\n")
+
+	// Each Save must write the combined value once, rather than growing it.
+	for i := 2; i < 4; i++ {
+		s := new(Store)
+		s.RepeatKeys(true)
+		if err := s.File(file); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set("main", "other", i); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Save(); err != nil {
+			t.Fatal(err)
+		}
+
+		saved := new(Store)
+		saved.RepeatKeys(true)
+		if err := saved.File(file); err != nil {
+			t.Fatal(err)
+		}
+		if got := saved.MGet("main", "header"); fmt.Sprint(got) != "[X Y Z]" {
+			data, _ := os.ReadFile(file)
+			t.Fatalf("header = %q, want [X Y Z], file:\n%s", got, data)
+		}
+		if got := saved.GetInt("main", "other"); got != int64(i) {
+			t.Errorf("other = %d, want %d.", got, i)
+		}
+	}
+}
+
+func TestGetRegexpEscapes(t *testing.T) {
+	file := writeConfig(t, "[main]\npattern = ^\\[foo\\]$\nclass = [a-c]+\nother = 1\n")
+	s := loadConfig(t, file)
+
+	check := func(s *Store) {
+		t.Helper()
+		re, err := s.GetRegexp("main", "pattern")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !re.MatchString("[foo]") || re.MatchString("f") {
+			t.Errorf("pattern %q compiled from an unescaped value.", re)
+		}
+		re, err = s.GetRegexp("main", "class")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !re.MatchString("abc") {
+			t.Errorf("class compiled as %q.", re)
+		}
+	}
+	check(s)
+
+	// Get still returns the value without escapes.
+	if got := s.Get("main", "pattern"); got != "^[foo]$" {
+		t.Errorf("Get = %q, want ^[foo]$.", got)
+	}
+
+	// Escapes survive a Save of the section.
+	if err := s.Set("main", "other", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	check(loadConfig(t, file))
+
+	// A value set in code is compiled as given.
+	if err := s.Set("main", "pattern", `^\(x\)$`); err != nil {
+		t.Fatal(err)
+	}
+	re, err := s.GetRegexp("main", "pattern")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !re.MatchString("(x)") {
+		t.Errorf("pattern compiled as %q after Set.", re)
+	}
+}
+
+func TestSectionColon(t *testing.T) {
+	file := writeConfig(t, "[base]\nkey = base\n\n[host:8080]\nport = 8080\n\n[http://example.com]\nurl = yes\n\n[child : base]\nown = 1\n")
+	s := loadConfig(t, file)
+
+	if got := fmt.Sprint(s.Sections()); got != "[base child host:8080 http://example.com]" {
+		t.Errorf("Sections = %s.", got)
+	}
+	if got := s.Get("host:8080", "port"); got != "8080" {
+		t.Errorf("[host:8080] port = %q, want 8080.", got)
+	}
+	if s.HasKey("host:8080", "key") || s.HasKey("http://example.com", "key") {
+		t.Error("a section with ':' in its name inherits from another section.")
+	}
+	if got := s.Get("child", "key"); got != "base" {
+		t.Errorf("[child : base] key = %q, want base.", got)
+	}
+
+	// Headers are written back unchanged.
+	if err := s.Set("host:8080", "port", "9090"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range []string{"[host:8080]\n", "[http://example.com]\n", "[child : base]\n"} {
+		if !strings.Contains(string(data), header) {
+			t.Errorf("saved file is missing %q:\n%s", header, data)
+		}
+	}
+}
+
+func TestEscapedBrackets(t *testing.T) {
+	file := writeConfig(t, "[main]\nlist = \\[first\\],\n  \\[second],\n  plain\nother = 1\n")
+	want := "[[first] [second] plain]"
+
+	s := loadConfig(t, file)
+	if got := fmt.Sprint(s.MGet("main", "list")); got != want {
+		t.Errorf("File: list = %s, want %s.", got, want)
+	}
+
+	var streamed []string
+	err := EachEntry(file, func(section, key string, values []string) error {
+		if key == "list" {
+			streamed = values
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(streamed); got != want {
+		t.Errorf("EachEntry: list = %s, want %s.", got, want)
+	}
+
+	// Values set in code are escaped on Save as needed.
+	if err := s.Set("main", "other", "[x]", "[y]", "z]"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved := loadConfig(t, file)
+	if got := fmt.Sprint(saved.MGet("main", "list")); got != want {
+		t.Errorf("after Save: list = %s, want %s.", got, want)
+	}
+	if got := fmt.Sprint(saved.MGet("main", "other")); got != "[[x] [y] z]]" {
+		t.Errorf("after Save: other = %s, want [[x] [y] z]].", got)
+	}
+	if got := fmt.Sprint(saved.Sections()); got != "[main]" {
+		t.Errorf("after Save: sections = %s, want [main].", got)
+	}
+}
+
+func TestUnterminatedList(t *testing.T) {
+	for _, data := range []string{
+		"[main]\nother = 1\nlist = a,\n",
+		"[main]\nother = 1\nlist = a,\n  b,",
+	} {
+		file := writeConfig(t, data)
+
+		err := new(Store).File(file)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%q: File returned %v, want a ParseError.", data, err)
+		}
+		if perr.Line != 3 || !strings.Contains(perr.Message, "Unterminated value list for key list") {
+			t.Errorf("%q: error at line %d: %s", data, perr.Line, perr.Message)
+		}
+
+		err = EachEntry(file, func(string, string, []string) error { return nil })
+		if !errors.As(err, &perr) || perr.Line != 3 {
+			t.Errorf("%q: EachEntry returned %v, want an error at line 3.", data, err)
+		}
+	}
+}
+
+func TestEqualsInValues(t *testing.T) {
+	file := writeConfig(t, "[main]\ntoken = a=b=c\nsecret = dGVzdA==\nquery = x=1&y=2,\n  z==3\n")
+
+	check := func(s *Store) {
+		t.Helper()
+		if got := s.Get("main", "token"); got != "a=b=c" {
+			t.Errorf("token = %q, want a=b=c.", got)
+		}
+		if got := s.Get("main", "secret"); got != "dGVzdA==" {
+			t.Errorf("secret = %q, want dGVzdA==.", got)
+		}
+		if got := fmt.Sprint(s.MGet("main", "query")); got != "[x=1&y=2 z==3]" {
+			t.Errorf("query = %s, want [x=1&y=2 z==3].", got)
+		}
+		if s.HasKey("main", "z") {
+			t.Error("continued value read as key z.")
+		}
+	}
+
+	s := loadConfig(t, file)
+	check(s)
+
+	flat, err := FlatSection(file, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flat["token"] != "a=b=c" || flat["secret"] != "dGVzdA==" {
+		t.Errorf("FlatSection = %q.", flat)
+	}
+
+	if err := s.Set("main", "secret", "YWJjZA=="); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("main", "token", "k=v="); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved := loadConfig(t, file)
+	if got := saved.Get("main", "secret"); got != "YWJjZA==" {
+		t.Errorf("after Save: secret = %q, want YWJjZA==.", got)
+	}
+	if got := saved.Get("main", "token"); got != "k=v=" {
+		t.Errorf("after Save: token = %q, want k=v=.", got)
+	}
+	if got := fmt.Sprint(saved.MGet("main", "query")); got != "[x=1&y=2 z==3]" {
+		t.Errorf("after Save: query = %s, want [x=1&y=2 z==3].", got)
+	}
+}
+
+func TestLatin1(t *testing.T) {
+	// "café" and "naïve" encoded as Latin-1.
+	file := writeConfig(t, "[main]\nok = yes\nname = caf\xe9\nword = na\xefve\n")
+
+	err := new(Store).File(file)
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("File returned %v, want a ParseError.", err)
+	}
+	if perr.Line != 3 || perr.Message != "Invalid UTF-8 found" || perr.File != file {
+		t.Errorf("error = %v, want invalid UTF-8 at line 3 of %s.", perr, file)
+	}
+
+	s, errs := LoadTolerant(file)
+	if len(errs) != 2 {
+		t.Fatalf("LoadTolerant returned %d errors, want 2: %v", len(errs), errs)
+	}
+	for i, line := range []int{3, 4} {
+		if perr, ok := errs[i].(*ParseError); !ok || perr.Line != line {
+			t.Errorf("error %d = %v, want line %d.", i, errs[i], line)
+		}
+	}
+	if s.Get("main", "ok") != "yes" || s.HasKey("main", "name") || s.HasKey("main", "word") {
+		t.Error("LoadTolerant kept lines with invalid UTF-8, or lost valid ones.")
+	}
+}
+
+func TestSetNewFile(t *testing.T) {
+	dir := t.TempDir()
+
+	// A missing file, in folders that don't exist yet.
+	file := filepath.Join(dir, "a", "b", "new.cfg")
+	s := new(Store)
+	if err := s.File(file); !errors.Is(err, ErrConfigNotFound) {
+		t.Fatalf("File returned %v, want ErrConfigNotFound.", err)
+	}
+	s.SetAutoSave(true)
+	if err := s.Set("main", "key", "value", "second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("other", "flag", true); err != nil {
+		t.Fatal(err)
+	}
+	saved := loadConfig(t, file)
+	if got := fmt.Sprint(saved.MGet("main", "key")); got != "[value second]" {
+		t.Errorf("key = %s, want [value second].", got)
+	}
+	if !saved.GetBool("other", "flag") {
+		t.Error("flag not saved.")
+	}
+
+	file = filepath.Join(dir, "c", "saved.cfg")
+	s = new(Store)
+	if err := s.Set("main", "key", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveAs(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadConfig(t, file).Get("main", "key"); got != "x" {
+		t.Errorf("SaveAs: key = %q, want x.", got)
+	}
+
+	file = filepath.Join(dir, "d", "appended.cfg")
+	if err := AppendFile(file, "main", "key", "y"); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadConfig(t, file).Get("main", "key"); got != "y" {
+		t.Errorf("AppendFile: key = %q, want y.", got)
+	}
+}
+
+func TestNormalizeNames(t *testing.T) {
+	file := writeConfig(t, "[Server]\nPort = 80\n")
+
+	exact := loadConfig(t, file)
+	if exact.Get("server", "port") != "" || !exact.HasKey("Server", "Port") {
+		t.Error("names matched without normalizing.")
+	}
+
+	s := new(Store)
+	s.NormalizeNames(strings.ToLower)
+	if err := s.File(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Get("SERVER", "port"); got != "80" {
+		t.Errorf("Get(SERVER, port) = %q, want 80.", got)
+	}
+	if !s.Exists("sErVeR") || !s.Exists("Server", "PORT") || !s.HasSection("SERVER") || !s.HasKey("server", "Port") {
+		t.Error("mixed-case names not found.")
+	}
+	if s.Exists("Server", "Host") {
+		t.Error("Exists found a missing key.")
+	}
+
+	if err := s.Set("SERVER", "Host", "example"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("server", "PORT", 8080); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(s.Keys("Server")); got != "[host port]" {
+		t.Errorf("Keys = %s, want [host port].", got)
+	}
+	if err := s.Save("Server"); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := new(Store)
+	saved.NormalizeNames(strings.ToLower)
+	if err := saved.File(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(saved.Sections()); got != "[server]" {
+		t.Errorf("after Save: sections = %s, want [server].", got)
+	}
+	if saved.Get("Server", "Port") != "8080" || saved.Get("Server", "host") != "example" {
+		data, _ := os.ReadFile(file)
+		t.Errorf("after Save, file holds:\n%s", data)
+	}
+}
+
+func TestEmptyValues(t *testing.T) {
+	file := writeConfig(t, "[main]\n")
+	s := loadConfig(t, file)
+
+	if err := s.Set("main", "list", "a", "", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("main", "blank", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := loadConfig(t, file)
+	if got := saved.MGet("main", "list"); len(got) != 3 || got[0] != "a" || got[1] != "" || got[2] != "b" {
+		data, _ := os.ReadFile(file)
+		t.Errorf("list = %q, want [a  b], file:\n%s", got, data)
+	}
+	if got, ok := saved.GetOK("main", "blank"); !ok || len(got) != 1 || got[0] != "" {
+		t.Errorf("blank = %q, %v, want one empty value.", got, ok)
+	}
+}
+
+func TestGetMaps(t *testing.T) {
+	s := new(Store)
+	err := s.Parse(`[main]
+labels = env=prod, team = web, empty=
+limits = cpu=4, mem=0x10
+features = search=yes, export=False
+no_equals = env=prod, team
+no_name = =prod
+repeated = env=prod, env=dev
+bad_int = cpu=four
+bad_bool = search=maybe
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels, err := s.GetStringMap("main", "labels")
+	if err != nil || fmt.Sprint(labels) != "map[empty: env:prod team:web]" {
+		t.Errorf("GetStringMap = %v, %v.", labels, err)
+	}
+	limits, err := s.GetIntMap("main", "limits")
+	if err != nil || limits["cpu"] != 4 || limits["mem"] != 16 {
+		t.Errorf("GetIntMap = %v, %v.", limits, err)
+	}
+	features, err := s.GetBoolMap("main", "features")
+	if err != nil || !features["search"] || features["export"] {
+		t.Errorf("GetBoolMap = %v, %v.", features, err)
+	}
+	if m, err := s.GetStringMap("main", "missing"); err != nil || len(m) != 0 {
+		t.Errorf("GetStringMap of a missing key = %v, %v.", m, err)
+	}
+
+	tests := []struct {
+		key  string
+		get  func(section, key string) error
+		want string
+	}{
+		{"no_equals", func(sec, key string) error { _, err := s.GetStringMap(sec, key); return err }, "entry 'team' is not in the form name=value"},
+		{"no_name", func(sec, key string) error { _, err := s.GetStringMap(sec, key); return err }, "entry '=prod' is not in the form name=value"},
+		{"repeated", func(sec, key string) error { _, err := s.GetStringMap(sec, key); return err }, "entry 'env=dev' repeats name 'env'"},
+		{"repeated", func(sec, key string) error { _, err := s.GetIntMap(sec, key); return err }, "repeats name 'env'"},
+		{"bad_int", func(sec, key string) error { _, err := s.GetIntMap(sec, key); return err }, "entry 'cpu' has invalid number 'four'"},
+		{"no_name", func(sec, key string) error { _, err := s.GetBoolMap(sec, key); return err }, "is not in the form name=value"},
+		{"bad_bool", func(sec, key string) error { _, err := s.GetBoolMap(sec, key); return err }, "entry 'search'"},
+	}
+	for _, test := range tests {
+		err := test.get("main", test.key)
+		if err == nil || !strings.Contains(err.Error(), test.want) || !strings.Contains(err.Error(), "[main] "+test.key+":") {
+			t.Errorf("%s: error = %v, want one containing %q.", test.key, err, test.want)
+		}
+	}
+}
+
+func TestQuotedSections(t *testing.T) {
+	names := []string{"Server Group 1", "a [b]", "c : d", "host:8080", "e#f", `g"h`, " padded "}
+
+	file := writeConfig(t, "[\"Server Group 1\"]\nkey = 1\n\n[\"a [b]\" : \"Server Group 1\"]\nown = 2\n")
+	s := loadConfig(t, file)
+	if got := s.Get("Server Group 1", "key"); got != "1" {
+		t.Errorf("[Server Group 1] key = %q, want 1.", got)
+	}
+	if got := s.Get("a [b]", "key"); got != "1" {
+		t.Errorf("[a [b]] inherited key = %q, want 1.", got)
+	}
+
+	for i, name := range names[2:] {
+		if err := s.Set(name, "n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Set("a [b]", "own", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := loadConfig(t, file)
+	data, _ := os.ReadFile(file)
+	want := append([]string{}, names...)
+	sort.Strings(want)
+	if got := saved.Sections(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("sections = %q, want %q, file:\n%s", got, want, data)
+	}
+	for i, name := range names[2:] {
+		if got := saved.GetInt(name, "n"); got != int64(i) {
+			t.Errorf("[%s] n = %d, want %d.", name, got, i)
+		}
+	}
+	if saved.GetInt("a [b]", "own") != 3 || saved.Get("a [b]", "key") != "1" {
+		t.Errorf("[a [b]] lost its value or parent, file:\n%s", data)
+	}
+	if !strings.Contains(string(data), "[\"a [b]\" : Server Group 1]\n") || !strings.Contains(string(data), "[host:8080]\n") {
+		t.Errorf("headers not written as expected:\n%s", data)
+	}
+
+	// Names read back from a header match the name written for them.
+	for _, name := range names {
+		if got, parent := splitSection(quoteSection(name)); got != name || parent != "" {
+			t.Errorf("%q written as %q, read back as %q : %q.", name, quoteSection(name), got, parent)
+		}
+	}
+}
+
+func TestLongValue(t *testing.T) {
+	long := strings.Repeat("x", 100<<10)
+	file := writeConfig(t, "[main]\nlong = "+long+"\nlist = a,\n  "+long+"\n")
+
+	s := loadConfig(t, file)
+	if got := s.Get("main", "long"); got != long {
+		t.Errorf("long value read as %d bytes, want %d.", len(got), len(long))
+	}
+	if got := s.MGet("main", "list"); len(got) != 2 || got[1] != long {
+		t.Error("long continued value not read.")
+	}
+
+	if err := s.Set("main", "other", long); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadConfig(t, file).Get("main", "other"); got != long {
+		t.Errorf("saved value read as %d bytes, want %d.", len(got), len(long))
+	}
+
+	// Lines past the limit fail with the line they are on.
+	s = new(Store)
+	s.MaxLineBytes(64 << 10)
+	err := s.File(file)
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Line != 2 || perr.File != file {
+		t.Errorf("File with a 64KB limit returned %v, want a ParseError at line 2.", err)
+	}
+}
+
+func TestUnsetMissing(t *testing.T) {
+	s := NewStore()
+	s.Unset("a", "b")
+	s.Unset("a")
+	if err := s.Set("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Dirty() {
+		t.Error("removing keys that don't exist marked the Store dirty.")
+	}
+
+	if err := s.Parse("[main]\nkey = x\n"); err != nil {
+		t.Fatal(err)
+	}
+	s.Unset("main", "missing")
+	if s.Dirty() {
+		t.Error("Unset of a missing key marked the Store dirty.")
+	}
+	s.Unset("main", "key")
+	if !s.Dirty() || s.HasKey("main", "key") {
+		t.Error("Unset of an existing key was not recorded.")
+	}
+}
+
+func TestBareKeysSave(t *testing.T) {
+	file := writeConfig(t, "[main]\nverbose # Chatty output.\nname = example\ndebug\nquiet\nlast = 1\n")
+	s := new(Store)
+	s.BareKeys(true)
+	if err := s.File(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set("main", "debug", "no"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("main", "name", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("main", "added", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[main]\nverbose # Chatty output.\nname = changed\ndebug = no\nquiet\nlast = 1\nadded = true\n"
+	if string(data) != want {
+		t.Errorf("Save wrote:\n%s\nwant:\n%s", data, want)
+	}
+}
@@ -0,0 +1,106 @@
+package cfg
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Reads a .env style file of KEY=value lines in to a read-only Store, with each variable held as a key of section "".
+// Lines may begin with "export", values may be single or double quoted, and lines beginning with '#' are ignored.
+func LoadEnvFile(file string) (*Store, error) {
+	s := new(Store)
+	if err := s.LoadEnvInto(file, empty); err != nil {
+		return nil, err
+	}
+	s.file = file
+	s.dirty = nil
+	s.flags.Set(opt_READ_ONLY)
+	return s, nil
+}
+
+// Reads a .env style file of KEY=value lines, setting each variable as a key of section.
+// Variables replace any value the key already holds.
+func (s *Store) LoadEnvInto(file, section string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cfgStore == nil {
+		s.cfgStore = make(map[string]map[string][]string)
+	}
+
+	section = s.norm(section)
+	vars := make(map[string][]string)
+
+	err = parseEnv(f, func(key, value string) {
+		vars[s.norm(key)] = []string{value}
+	})
+	if err != nil {
+		return fileErr(file, err)
+	}
+
+	if s.cfgStore[section] == nil {
+		s.cfgStore[section] = make(map[string][]string)
+	}
+	for k, v := range vars {
+		s.cfgStore[section][k] = v
+	}
+	s.touch(section)
+	return nil
+}
+
+// Parses KEY=value lines, calling fn for each variable.
+func parseEnv(input io.Reader, fn func(key, value string)) error {
+	sc := newScanner(input, 0)
+	var line int
+
+	for sc.Scan() {
+		line++
+		txt := strings.TrimSpace(sc.Text())
+		if line == 1 {
+			txt = strings.TrimPrefix(txt, utf8_BOM)
+		}
+		if len(txt) == 0 || txt[0] == '#' {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(txt, "export"); ok && len(rest) > 0 && (rest[0] == ' ' || rest[0] == '\t') {
+			txt = strings.TrimSpace(rest)
+		}
+
+		key, value, ok := strings.Cut(txt, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == empty {
+			return cfgErr(line)
+		}
+		value = strings.TrimSpace(value)
+
+		switch {
+		case len(value) > 1 && value[0] == '"':
+			// Double quoted values may hold escapes, anything after the closing quote is ignored.
+			q, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				return cfgErr(line)
+			}
+			value, _ = strconv.Unquote(q)
+		case len(value) > 1 && value[0] == '\'':
+			end := strings.IndexByte(value[1:], '\'')
+			if end < 0 {
+				return cfgErr(line)
+			}
+			value = value[1 : end+1]
+		default:
+			if n := strings.Index(value, " #"); n > -1 {
+				value = strings.TrimSpace(value[:n])
+			}
+		}
+		fn(key, value)
+	}
+	return sc.Err()
+}
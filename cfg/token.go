@@ -0,0 +1,269 @@
+package cfg
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Kind of Token returned by Tokenize.
+type TokenKind int
+
+const (
+	TokenSection TokenKind = iota // Section name, without brackets.
+	TokenKey                      // Key name.
+	TokenValue                    // Single value of a key, as written in the file.
+	TokenComment                  // Comment, including its leading '#' or ';'.
+)
+
+// Piece of configuration found by Tokenize, columns are byte offsets starting at 1, EndCol is exclusive.
+type Token struct {
+	Kind   TokenKind
+	Text   string
+	Line   int
+	Col    int
+	EndCol int
+}
+
+// Splits configuration data in to tokens with their positions, for tools such as syntax highlighters.
+// Lines are classified the same way they are when parsing, however malformed lines are tokenized rather than rejected.
+func Tokenize(r io.Reader) (tokens []Token, err error) {
+	sc := newScanner(r, 0)
+
+	var (
+		line      int
+		continued bool
+	)
+
+	add := func(kind TokenKind, raw string, start, end int) {
+		// Trim surrounding space, keeping columns aligned with the text.
+		for start < end && (raw[start] == ' ' || raw[start] == '\t') {
+			start++
+		}
+		for end > start && (raw[end-1] == ' ' || raw[end-1] == '\t') {
+			end--
+		}
+		if start == end {
+			return
+		}
+		tokens = append(tokens, Token{kind, raw[start:end], line, start + 1, end + 1})
+	}
+
+	// Adds a value token for each ',' separated value between start and end.
+	values := func(raw string, start, end int) {
+		base := start
+		for _, n := range separators(raw[base:end], ',') {
+			add(TokenValue, raw, start, base+n)
+			start = base + n + 1
+		}
+		add(TokenValue, raw, start, end)
+	}
+
+	for sc.Scan() {
+		line++
+		raw := sc.Text()
+		if line == 1 && strings.HasPrefix(raw, utf8_BOM) {
+			raw = strings.Repeat(" ", len(utf8_BOM)) + raw[len(utf8_BOM):]
+		}
+
+		end := len(raw)
+		if txt := strings.TrimSpace(raw); strings.HasPrefix(txt, ";") {
+			end = strings.Index(raw, ";")
+		} else if n := separators(raw, '#'); len(n) > 0 {
+			end = n[0]
+		}
+
+		txt := strings.TrimSpace(raw[:end])
+		switch {
+		case len(txt) == 0:
+		case txt[0] == '[' && txt[len(txt)-1] == ']':
+			open := strings.Index(raw, "[")
+			close := strings.LastIndex(raw[:end], "]")
+			add(TokenSection, raw, open+1, close)
+			continued = false
+		default:
+			if eq := separators(raw[:end], '='); len(eq) > 0 && !continued {
+				add(TokenKey, raw, 0, eq[0])
+				values(raw, eq[0]+1, end)
+			} else {
+				values(raw, 0, end)
+			}
+			continued = strings.HasSuffix(txt, ",")
+		}
+		add(TokenComment, raw, end, len(raw))
+	}
+	return tokens, sc.Err()
+}
+
+// Returns positions of sepr in input, skipping any that are quoted or escaped.
+func separators(input string, sepr byte) (out []int) {
+	var quoted, escaped bool
+	for i := 0; i < len(input); i++ {
+		switch ch := input[i]; {
+		case escaped:
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case ch == '"':
+			quoted = !quoted
+		case ch == sepr && !quoted:
+			out = append(out, i)
+		}
+	}
+	return
+}
+
+// Formats configuration data, like gofmt does for Go source, keeping sections, keys, values and comments in file order.
+// Spacing around '=' and ',' is normalized, continued values are aligned under the first value, and indentation is removed.
+// Values and comments are kept exactly as written, src must parse without error.
+func Format(src []byte) ([]byte, error) {
+	return format(src, false)
+}
+
+// Formats configuration data as Format does, but with the keys of each section sorted by name.
+// Comments and blank lines directly above a key move with it, those at the end of a section stay at the end.
+func FormatSorted(src []byte) ([]byte, error) {
+	return format(src, true)
+}
+
+// Formatted line, with the key it starts, if any.
+type fmtLine struct {
+	text      string
+	key       string
+	section   bool
+	continued bool
+}
+
+func format(src []byte, sorted bool) ([]byte, error) {
+	err := scan(bytes.NewReader(src), parseOpts{}, nil, func(int, string, string, []string, []string) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := Tokenize(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		lines  []fmtLine
+		line   int
+		indent int
+		next   int
+	)
+
+	sc := newScanner(bytes.NewReader(src), 0)
+	for sc.Scan() {
+		line++
+
+		var (
+			out     bytes.Buffer
+			fl      fmtLine
+			values  []string
+			comment string
+		)
+
+		for ; next < len(tokens) && tokens[next].Line == line; next++ {
+			t := tokens[next]
+			switch t.Kind {
+			case TokenSection:
+				out.WriteString("[" + t.Text + "]")
+				fl.section = true
+			case TokenKey:
+				out.WriteString(t.Text + " =")
+				indent = len(t.Text) + 3
+				fl.key = t.Text
+			case TokenValue:
+				values = append(values, t.Text)
+			case TokenComment:
+				comment = t.Text
+			}
+		}
+
+		if len(values) > 0 {
+			if out.Len() == 0 {
+				out.WriteString(strings.Repeat(" ", indent))
+				fl.continued = true
+			} else {
+				out.WriteByte(' ')
+			}
+			out.WriteString(strings.Join(values, ", "))
+		}
+
+		// Keep the trailing ',' that continues a list on to the next line.
+		txt := sc.Text()
+		if n := separators(txt, '#'); len(n) > 0 {
+			txt = txt[:n[0]]
+		}
+		if strings.HasSuffix(strings.TrimSpace(txt), ",") && len(values) > 0 {
+			out.WriteByte(',')
+		}
+
+		if comment != empty {
+			if out.Len() > 0 {
+				out.WriteByte(' ')
+			}
+			out.WriteString(comment)
+		}
+		fl.text = out.String()
+		lines = append(lines, fl)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if sorted {
+		lines = sortKeys(lines)
+	}
+
+	var out bytes.Buffer
+	for _, l := range lines {
+		out.WriteString(l.text)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), nil
+}
+
+// Sorts the keys within each section, each key taking along the lines above it and its continued values.
+func sortKeys(lines []fmtLine) (out []fmtLine) {
+	type entry struct {
+		key   string
+		lines []fmtLine
+	}
+
+	var (
+		entries []entry
+		pending []fmtLine
+	)
+
+	flush := func() {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return strings.ToLower(entries[i].key) < strings.ToLower(entries[j].key)
+		})
+		for _, e := range entries {
+			out = append(out, e.lines...)
+		}
+		out = append(out, pending...)
+		entries, pending = nil, nil
+	}
+
+	for _, l := range lines {
+		switch {
+		case l.section:
+			flush()
+			out = append(out, l)
+		case l.key != empty:
+			entries = append(entries, entry{l.key, append(pending, l)})
+			pending = nil
+		case l.continued && len(entries) > 0:
+			e := &entries[len(entries)-1]
+			e.lines = append(append(e.lines, pending...), l)
+			pending = nil
+		default:
+			pending = append(pending, l)
+		}
+	}
+	flush()
+	return
+}
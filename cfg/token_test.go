@@ -0,0 +1,73 @@
+package cfg
+
+import (
+	"testing"
+)
+
+const unformatted = `# Server settings.
+[server]
+  port=8080   # Listen port.
+hosts =a,b,
+      c
+; Name shown to clients.
+name= example
+
+[client]
+ timeout =5
+`
+
+func TestFormat(t *testing.T) {
+	want := `# Server settings.
+[server]
+port = 8080 # Listen port.
+hosts = a, b,
+        c
+; Name shown to clients.
+name = example
+
+[client]
+timeout = 5
+`
+	out, err := Format([]byte(unformatted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Errorf("Format returned:\n%s\nwant:\n%s", out, want)
+	}
+
+	again, err := Format(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(out) {
+		t.Errorf("Format of formatted output changed it:\n%s", again)
+	}
+}
+
+func TestFormatSorted(t *testing.T) {
+	want := `# Server settings.
+[server]
+hosts = a, b,
+        c
+; Name shown to clients.
+name = example
+port = 8080 # Listen port.
+
+[client]
+timeout = 5
+`
+	out, err := FormatSorted([]byte(unformatted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Errorf("FormatSorted returned:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestFormatInvalid(t *testing.T) {
+	if _, err := Format([]byte("[main]\nno equals sign\n")); err == nil {
+		t.Error("Format accepted a line without a key.")
+	}
+}
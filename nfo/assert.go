@@ -0,0 +1,31 @@
+package nfo
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Set when a failed Assert should panic.
+var assert_panic int32
+
+// Sets whether a failed Assert panics after logging, such as during development, by default it is only logged.
+func SetAssertMode(enable bool) {
+	if enable {
+		atomic.StoreInt32(&assert_panic, 1)
+	} else {
+		atomic.StoreInt32(&assert_panic, 0)
+	}
+}
+
+// Checks an invariant, when cond is false the message is logged as Error, formatted as with fmt.Sprintf.
+// If SetAssertMode(true) was called, Assert then panics with the message.
+func Assert(cond bool, format string, vars ...interface{}) {
+	if cond {
+		return
+	}
+	msg := "Assertion failed: " + fmt.Sprintf(format, vars...)
+	write2log(ERROR, msg)
+	if atomic.LoadInt32(&assert_panic) == 1 {
+		panic(msg)
+	}
+}
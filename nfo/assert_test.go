@@ -0,0 +1,37 @@
+package nfo
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAssert(t *testing.T) {
+	defer CloseLogging()
+	defer SetAssertMode(false)
+
+	var buf bytes.Buffer
+	SetOutput(ALL, &buf)
+
+	Assert(true, "not logged")
+	Assert(false, "count is %d", 3)
+	if got := buf.String(); got != "[ERROR] Assertion failed: count is 3\n" {
+		t.Errorf("logged %q.", got)
+	}
+
+	buf.Reset()
+	SetAssertMode(true)
+	Assert(true, "not logged")
+
+	var recovered interface{}
+	func() {
+		defer func() { recovered = recover() }()
+		Assert(false, "count is %d", 4)
+	}()
+	if msg, _ := recovered.(string); msg != "Assertion failed: count is 4" {
+		t.Errorf("Assert panicked with %v.", recovered)
+	}
+	if !strings.Contains(buf.String(), "Assertion failed: count is 4") {
+		t.Errorf("Assert did not log before panicking, logged %q.", buf.String())
+	}
+}
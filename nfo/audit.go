@@ -0,0 +1,65 @@
+package nfo
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Audit file of a Logger, and the loggers mirrored to it.
+type auditLog struct {
+	file  *os.File
+	close func() error
+	flags uint32
+}
+
+// Mirrors entries of the specified loggers to an append-only audit file, which is never rotated.
+// Each entry is timestamped and synced to disk as it is written, regardless of other output settings.
+func SetAuditLog(filename string, flag uint32) error {
+	return std.SetAuditLog(filename, flag)
+}
+
+// Mirrors entries of the specified loggers to an append-only audit file, which is never rotated.
+// Each entry is timestamped and synced to disk as it is written, regardless of other output settings.
+func (L *Logger) SetAuditLog(filename string, flag uint32) error {
+	fpath, _ := filepath.Split(filename)
+
+	if err := mkDir(fpath); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Registered before taking mutex, as the global defer may need it.
+	close := registerDefer("", f.Close)
+
+	// Entries are written with mutex held, so none are left writing to the previous file once it is swapped out.
+	mutex.Lock()
+	L.mutex.Lock()
+	prev := L.audit.close
+	L.audit = auditLog{f, close, flag}
+	L.mutex.Unlock()
+	mutex.Unlock()
+
+	if prev != nil {
+		prev()
+	}
+	return nil
+}
+
+// Writes entry to audit file, if logger is audited, mutex must be held by caller.
+func (L *Logger) writeAudit(flag uint32, entry []byte) (err error) {
+	L.mutex.Lock()
+	audit := L.audit
+	L.mutex.Unlock()
+
+	if audit.file == nil || audit.flags&flag != flag {
+		return nil
+	}
+	if _, err = audit.file.Write(entry); err != nil {
+		return err
+	}
+	return audit.file.Sync()
+}
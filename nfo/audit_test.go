@@ -0,0 +1,39 @@
+package nfo
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetAuditLog(t *testing.T) {
+	defer CloseLogging()
+	SetOutput(ALL, None)
+
+	file := filepath.Join(t.TempDir(), "audit.log")
+
+	// SetAuditLog registers with the global defer, which must not wait on the lock SetAuditLog holds.
+	done := make(chan error, 1)
+	go func() { done <- SetAuditLog(file, ERROR) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SetAuditLog did not return.")
+	}
+
+	Log("not audited")
+	Err("audited")
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); !strings.Contains(got, "audited") || strings.Contains(got, "not audited") {
+		t.Errorf("audit file holds %q, want only the error entry.", got)
+	}
+}
@@ -0,0 +1,134 @@
+package nfo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cmcoffee/go-snuglib/cfg"
+)
+
+// Log file opened by ConfigureFromStore, along with the settings it was opened with.
+var configured struct {
+	file  string
+	size  uint64
+	count uint64
+	w     io.Writer
+	close func() error
+	level uint32
+	// Outputs of loggers discarded by level, restored when the level shows them again.
+	hidden map[uint32]io.Writer
+}
+
+// Applies logging settings held under section of s, such as a [logging] section of the application's config file.
+//
+//	level = trace, debug, info, notice, warn or error, entries below level are discarded.
+//	file = path of a log file all loggers are written to.
+//	rotate_size = size in megabytes the log file reaches before it is rotated, 0 disables rotation.
+//	rotate_count = number of rotated log files to keep.
+//	tag = tag written at the start of each entry, as with SetGlobalTag.
+//
+// Keys that are not set leave the current settings as they are. Calling ConfigureFromStore again after the
+// Store has been reloaded applies any changes, the log file is only reopened when its settings change.
+func ConfigureFromStore(s *cfg.Store, section string) error {
+	if s.HasKey(section, "level") {
+		level := strings.ToLower(s.Get(section, "level"))
+		var min uint32
+		for flag, name := range level_names {
+			if name == level && flag&(DEBUG|TRACE|INFO|NOTICE|WARN|ERROR) != 0 {
+				min = flag
+			}
+		}
+		if min == 0 {
+			return fmt.Errorf("[%s] level: '%s' is not valid, must be one of: trace, debug, info, notice, warn, error.", section, level)
+		}
+		setLevel(min)
+	}
+
+	if s.HasKey(section, "file") {
+		file := s.Get(section, "file")
+		size, count := s.GetUint(section, "rotate_size"), s.GetUint(section, "rotate_count")
+		mutex.Lock()
+		changed := file != configured.file || size != configured.size || count != configured.count
+		mutex.Unlock()
+		if changed {
+			if err := configureFile(file, size, count); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.HasKey(section, "tag") {
+		SetGlobalTag(s.Get(section, "tag"))
+	}
+	return nil
+}
+
+// Discards loggers below min, loggers at or above min get back the output they had before being discarded,
+// or standard out for loggers that were never shown, such as Debug. All are sent to the configured log file.
+func setLevel(min uint32) {
+	show := AtLeast(min)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	configured.level = min
+	if configured.hidden == nil {
+		configured.hidden = make(map[uint32]io.Writer)
+	}
+
+	std.mutex.Lock()
+	defer std.mutex.Unlock()
+	for flag, l := range std.l_map {
+		if flag&ALL != flag {
+			continue
+		}
+		if show&flag == 0 {
+			if l.textout != None {
+				configured.hidden[flag] = l.textout
+				l.textout = None
+			}
+			if configured.w != nil {
+				l.fileout = None
+			}
+		} else {
+			if l.textout == None {
+				if w, ok := configured.hidden[flag]; ok {
+					l.textout = w
+				} else {
+					l.textout = os.Stdout
+				}
+			}
+			delete(configured.hidden, flag)
+			if configured.w != nil {
+				l.fileout = configured.w
+			}
+		}
+	}
+}
+
+// Sends loggers shown by the configured level to file, closing any log file previously opened by ConfigureFromStore.
+func configureFile(file string, size, count uint64) error {
+	w, close, err := openLogFile(file, uint(size), uint(count))
+	if err != nil {
+		return err
+	}
+	mutex.Lock()
+	prev := configured.close
+	level := configured.level
+	configured.w = w
+	configured.close = close
+	configured.file, configured.size, configured.count = file, size, count
+	mutex.Unlock()
+
+	if level != 0 {
+		setLevel(level)
+	} else {
+		SetFile(ALL, w)
+	}
+
+	if prev != nil {
+		return prev()
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package nfo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cmcoffee/go-snuglib/cfg"
+)
+
+func TestConfigureFromStore(t *testing.T) {
+	defer CloseLogging()
+
+	var out bytes.Buffer
+	SetOutput(ALL, &out)
+
+	dir := t.TempDir()
+	s := cfg.NewStore()
+	s.Set("logging", "level", "warn")
+	s.Set("logging", "file", filepath.Join(dir, "a.log"))
+	if err := ConfigureFromStore(s, "logging"); err != nil {
+		t.Fatal(err)
+	}
+	Log("hidden info")
+	Warn("shown warn")
+
+	// Lowering the level must give Info back the writer it had, rather than standard out.
+	s.Set("logging", "level", "info")
+	s.Set("logging", "file", filepath.Join(dir, "b.log"))
+	if err := ConfigureFromStore(s, "logging"); err != nil {
+		t.Fatal(err)
+	}
+	Log("shown info")
+	Debug("hidden debug")
+
+	for _, want := range []string{"shown warn", "shown info"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+	for _, hidden := range []string{"hidden info", "hidden debug"} {
+		if strings.Contains(out.String(), hidden) {
+			t.Errorf("output holds %q:\n%s", hidden, out.String())
+		}
+	}
+
+	a, _ := os.ReadFile(filepath.Join(dir, "a.log"))
+	b, _ := os.ReadFile(filepath.Join(dir, "b.log"))
+	if !strings.Contains(string(a), "shown warn") || strings.Contains(string(a), "hidden info") {
+		t.Errorf("a.log holds:\n%s", a)
+	}
+	if !strings.Contains(string(b), "shown info") || strings.Contains(string(b), "shown warn") || strings.Contains(string(b), "hidden debug") {
+		t.Errorf("b.log holds:\n%s", b)
+	}
+
+	s.Set("logging", "level", "loud")
+	if err := ConfigureFromStore(s, "logging"); err == nil {
+		t.Error("an unknown level was accepted.")
+	}
+}
@@ -0,0 +1,63 @@
+package nfo
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cmcoffee/go-snuglib/cfg"
+)
+
+// Buffer safe to write from the goroutine SafeGo starts.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestCrashOutputLevel(t *testing.T) {
+	defer CloseLogging()
+	defer SetCrashOutput(nil)
+
+	var out, crash syncBuffer
+	SetOutput(ALL, &out)
+	SetCrashOutput(&crash)
+
+	s := cfg.NewStore()
+	s.Set("logging", "level", "error")
+	if err := ConfigureFromStore(s, "logging"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	SafeGo(func() {
+		defer close(done)
+		panic("boom")
+	})
+	<-done
+	// The panic is recorded once SafeGo's recover returns.
+	for i := 0; i < 100 && crash.String() == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	got := crash.String()
+	if !strings.Contains(got, "(panic) boom") || !strings.Contains(got, "TestCrashOutputLevel") {
+		t.Errorf("crash output holds %q, want the panic and its stack.", got)
+	}
+	if strings.Contains(out.String(), "[DEBUG]") {
+		t.Errorf("debug entries written with level raised to error:\n%s", out.String())
+	}
+}
@@ -1,24 +1,43 @@
 package nfo
 
 import (
+	"context"
 	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"runtime"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 var (
 	// Signal Notification Channel. (ie..nfo.Signal<-os.Kill will initiate a shutdown.)
-	signalChan  = make(chan os.Signal)
-	globalDefer struct {
-		mutex sync.RWMutex
-		ids   []string
-		d_map map[string]func() error
+	signalChan    = make(chan os.Signal, 1)
+	shutdownChan  = make(chan struct{}, 1)
+	shutdownBegun = make(chan struct{})
+	globalDefer   struct {
+		mutex  sync.RWMutex
+		ids    []string
+		d_map  map[string]func() error
+		names  map[string]string
+		report func(report []DeferReport, total time.Duration)
 	}
-	errCode   = 0
+	shutdownState struct {
+		mutex   sync.Mutex
+		timeout time.Duration
+		ctx     context.Context
+		base    context.Context
+		cancel  context.CancelFunc
+	}
+	errCode   int32 // accessed atomically.
 	wait      sync.WaitGroup
 	exit_lock = make(chan struct{})
 )
@@ -31,8 +50,15 @@ func ShutdownInProgress() bool {
 	return false
 }
 
+// Returns true once a shutdown has begun, from a signal, Exit or Fatal.
+// Periodic tasks can poll this before starting new work, or select on ShutdownContext instead.
+func ShuttingDown() bool {
+	return ShutdownInProgress()
+}
+
 // Global wait group, allows running processes to finish up tasks before app shutdown
 func BlockShutdown() {
+	listenSignals()
 	wait.Add(1)
 }
 
@@ -41,19 +67,116 @@ func UnblockShutdown() {
 	wait.Done()
 }
 
-// Adds a function to the global defer, function must take no arguments and either return nothing or return an error.
+// Blocks shutdown until ctx is done, so a worker driven by ctx holds up shutdown for as long as it runs without calling UnblockShutdown.
+func BlockShutdownCtx(ctx context.Context) {
+	BlockShutdown()
+	go func() {
+		<-ctx.Done()
+		UnblockShutdown()
+	}()
+}
+
+// Blocks until shutdown begins, from a signal, Shutdown, Exit or Fatal, so main can be parked until the application is stopped.
+// Shutdown carries on while the caller resumes, work that must complete before the application exits should be covered by BlockShutdown.
+func WaitForShutdown() {
+	listenSignals()
+	<-shutdownBegun
+}
+
+// Sets how long deferred functions taking a context.Context have to complete once shutdown begins, 0 disables the deadline.
+func SetShutdownTimeout(timeout time.Duration) {
+	shutdownState.mutex.Lock()
+	defer shutdownState.mutex.Unlock()
+	shutdownState.timeout = timeout
+}
+
+// Returns a context that is cancelled once shutdown exceeds the timeout set with SetShutdownTimeout, or as the application exits.
+// Long running tasks can use it to know when they have run out of time to finish up.
+func ShutdownContext() context.Context {
+	shutdownState.mutex.Lock()
+	defer shutdownState.mutex.Unlock()
+	return shutdownState.base
+}
+
+// Starts the shutdown deadline, returns the context handed to deferred functions for the remainder of shutdown.
+func beginShutdown() (context.Context, context.CancelFunc) {
+	shutdownState.mutex.Lock()
+	defer shutdownState.mutex.Unlock()
+
+	ctx, cancel := shutdownState.base, shutdownState.cancel
+
+	if shutdownState.timeout > 0 {
+		var timeout_cancel context.CancelFunc
+		ctx, timeout_cancel = context.WithTimeout(shutdownState.base, shutdownState.timeout)
+		go func() {
+			<-ctx.Done()
+			cancel()
+		}()
+		cancel = func() {
+			timeout_cancel()
+			shutdownState.cancel()
+		}
+	}
+
+	shutdownState.ctx = ctx
+	return ctx, cancel
+}
+
+// Returns the context handed to deferred functions, shared by all of them once shutdown has begun.
+func deferContext() (context.Context, context.CancelFunc) {
+	shutdownState.mutex.Lock()
+	defer shutdownState.mutex.Unlock()
+	if shutdownState.ctx != nil {
+		return shutdownState.ctx, func() {}
+	}
+	if shutdownState.timeout > 0 {
+		return context.WithTimeout(context.Background(), shutdownState.timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// Adds a function to the global defer, function must either take no arguments or a context.Context and either return nothing or return an error.
+// Functions taking a context.Context are given the shutdown context, which expires after the timeout set with SetShutdownTimeout.
 // Returns function to be called by local keyword defer if you want to run it now and remove it from global defer.
+// If closer is not a supported function, nothing is deferred and the returned function only returns an error.
 func Defer(closer interface{}) func() error {
-	globalDefer.mutex.Lock()
-	defer globalDefer.mutex.Unlock()
+	return addDefer("", closer)
+}
+
+// Adds closer to the global defer under name, the name of the function is used if name is empty.
+func addDefer(name string, closer interface{}) func() error {
+	listenSignals()
+	return registerDefer(name, closer)
+}
+
+// Adds closer to the global defer as addDefer does, without capturing OS signals.
+// Used by nfo's own cleanup, so opening a log file or starting a ticker doesn't change how the application handles signals.
+func registerDefer(name string, closer interface{}) func() error {
+	var d func() error
 
-	errorWrapper := func(closerFunc func()) func() error {
-		return func() error {
-			closerFunc()
+	switch closer := closer.(type) {
+	case func():
+		d = func() error {
+			closer()
 			return nil
 		}
+	case func() error:
+		d = closer
+	case func(context.Context) error:
+		d = func() error {
+			ctx, cancel := deferContext()
+			defer cancel()
+			return closer(ctx)
+		}
+	default:
+		err := fmt.Errorf("Defer: unsupported function signature %T.", closer)
+		Err(err)
+		return func() error { return err }
 	}
 
+	globalDefer.mutex.Lock()
+	defer globalDefer.mutex.Unlock()
+
 	var id string
 
 	for {
@@ -76,24 +199,18 @@ func Defer(closer interface{}) func() error {
 		}
 	}
 
-	var d func() error
-
-	switch closer := closer.(type) {
-	case func():
-		d = errorWrapper(closer)
-	case func() error:
-		d = closer
-	default:
-		return nil
-	}
-
 	globalDefer.ids = append(globalDefer.ids, id)
 	globalDefer.d_map[id] = d
+	if name == "" {
+		name = funcName(closer)
+	}
+	globalDefer.names[id] = name
 
 	return func() error {
 		globalDefer.mutex.Lock()
 		defer globalDefer.mutex.Unlock()
 		delete(globalDefer.d_map, id)
+		delete(globalDefer.names, id)
 		for i := len(globalDefer.ids) - 1; i > -1; i-- {
 			if globalDefer.ids[i] == id {
 				globalDefer.ids = append(globalDefer.ids[:i], globalDefer.ids[i+1:]...)
@@ -103,30 +220,156 @@ func Defer(closer interface{}) func() error {
 	}
 }
 
+// Time taken by a deferred function during shutdown.
+type DeferReport struct {
+	Name     string        // Name of the deferred function.
+	Duration time.Duration // Time taken to run.
+	Err      error         // Error returned, if any.
+}
+
+// Sets a function to receive the time taken by each deferred function once all have run during shutdown.
+// Timings are also logged as Debug.
+func ShutdownReport(fn func(report []DeferReport, total time.Duration)) {
+	globalDefer.mutex.Lock()
+	defer globalDefer.mutex.Unlock()
+	globalDefer.report = fn
+}
+
+// Returns name of function, for reporting.
+func funcName(f interface{}) string {
+	if fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); fn != nil {
+		return strings.TrimSuffix(fn.Name(), "-fm")
+	}
+	return "unknown"
+}
+
+// Adds graceful shutdown of srv to the global defer, in-flight requests are given until the shutdown timeout to complete.
+// Global defers run in reverse order, so register the server after anything its handlers depend upon.
+func DeferServer(srv *http.Server) func() error {
+	return addDefer("http.Server.Shutdown", func(ctx context.Context) error {
+		if err := srv.Shutdown(ctx); err != nil {
+			srv.Close()
+			return err
+		}
+		return nil
+	})
+}
+
+// Shuts down the application with exit_code, running the global defer and waiting on BlockShutdown just as a signal would.
+// Signal callbacks are not consulted.
+func Shutdown(exit_code int) {
+	atomic.StoreInt32(&fatal_triggered, 2) // Ignore any Fatal() calls, we've been told to exit.
+	atomic.StoreInt32(&errCode, int32(exit_code))
+	startHandler()
+	shutdownChan <- struct{}{}
+	<-exit_lock
+	os.Exit(exit_code)
+}
+
+// Receives stack traces of caught panics, see SetCrashOutput.
+var crash_out io.Writer
+
+// Sets w to receive the stack trace of every panic caught by Exit, RecoverAndLog or SafeGo,
+// regardless of which loggers are enabled, so crashes are recorded even when Fatal or Error output is discarded.
+func SetCrashOutput(w io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	crash_out = w
+}
+
+// Writes a caught panic and its stack trace to the crash output, if one is set.
+func writeCrash(r interface{}, stack []byte) {
+	std.mutex.Lock()
+	timezone := std.timezone
+	std.mutex.Unlock()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if crash_out == nil {
+		return
+	}
+	var ts []byte
+	genTS(&ts, clock().In(timezone))
+	fmt.Fprintf(crash_out, "%s(panic) %v\n%s\n", ts, r, stack)
+}
+
 // Intended to be a defer statement at the begining of main, but can be called at anytime with an exit code.
 // Tries to catch a panic if possible and log it as a fatal error,
 // then proceeds to send a signal to the global defer/shutdown handler
 func Exit(exit_code int) {
 	if r := recover(); r != nil {
-		Fatal("(panic) %s", string(debug.Stack()))
+		stack := debug.Stack()
+		writeCrash(r, stack)
+		Fatal("(panic) %s", string(stack))
 	} else {
-		atomic.StoreInt32(&fatal_triggered, 2) // Ignore any Fatal() calls, we've been told to exit.
-		signalChan <- os.Kill
-		<-exit_lock
-		os.Exit(exit_code)
+		Shutdown(exit_code)
+	}
+}
+
+// Intended to be a defer statement at the beginning of a goroutine, catches a panic and logs it along with its stack trace as a fatal error.
+// The panic is not re-raised, instead the application is shutdown through the global defer just as Exit would.
+func RecoverAndLog() {
+	if r := recover(); r != nil {
+		stack := debug.Stack()
+		writeCrash(r, stack)
+		Fatal("(panic) %v\n%s", r, string(stack))
 	}
 }
 
+// Runs fn in a new goroutine, a panic in fn is recovered and logged as an error along with its stack trace.
+// Unlike RecoverAndLog the application keeps running, making it suited to tasks of a worker pool.
+func SafeGo(fn func()) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				atomic.AddUint64(&recovered_panics, 1)
+				stack := debug.Stack()
+				writeCrash(r, stack)
+				Err("(panic) %v\n%s", r, string(stack))
+			}
+		}()
+		fn()
+	}()
+}
+
+var (
+	signals_once sync.Once
+	handler_once sync.Once
+)
+
+// Starts listening for the default signals, unless SetSignals or DisableSignalHandling was called beforehand.
+// Signals are not captured until the global defer is put to use, so importing nfo only for logging leaves signals alone.
+// Doesn't take mutex, as Defer may be called with it held, SetSignals waits on signals_once before changing signals.
+func listenSignals() {
+	startHandler()
+	signals_once.Do(func() {
+		signal.Notify(signalChan, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM, syscall.SIGHUP)
+	})
+}
+
 // Sets the signals that we listen for.
 func SetSignals(sig ...os.Signal) {
+	signals_once.Do(func() {})
+	startHandler()
 	mutex.Lock()
 	defer mutex.Unlock()
 	signal.Stop(signalChan)
 	signal.Notify(signalChan, sig...)
 }
 
+// Stops listening for OS signals so the application can handle them itself, Exit and Fatal will still perform a shutdown.
+// Calling SetSignals afterwards resumes listening for the signals provided.
+func DisableSignalHandling() {
+	signals_once.Do(func() {})
+	mutex.Lock()
+	defer mutex.Unlock()
+	signal.Stop(signalChan)
+}
+
 // Set a callback function(no arguments) to run after receiving a specific syscall, function returns true to continue shutdown process.
 func SignalCallback(signal os.Signal, callback func() (continue_shutdown bool)) {
+	listenSignals()
 	mutex.Lock()
 	defer mutex.Unlock()
 	callbacks[signal] = callback
@@ -134,63 +377,164 @@ func SignalCallback(signal os.Signal, callback func() (continue_shutdown bool))
 
 var callbacks = make(map[os.Signal]func() bool)
 
+type signalMessage struct {
+	logger uint32
+	msg    string
+}
+
+var signal_messages = make(map[os.Signal]signalMessage)
+
+// Sets a message to log when signal starts a shutdown, as Info unless another logger is specified.
+// An empty msg removes the message for signal.
+func SetSignalMessage(signal os.Signal, msg string, logger ...uint32) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if msg == "" {
+		delete(signal_messages, signal)
+		return
+	}
+	flag := uint32(INFO)
+	if len(logger) > 0 {
+		flag = logger[0]
+	}
+	signal_messages[signal] = signalMessage{flag, msg}
+}
+
+var declined_hooks []func(signal os.Signal)
+
+// Registers fn to be called whenever a SignalCallback declines to shutdown, the application continues running afterwards.
+func OnShutdownDeclined(fn func(signal os.Signal)) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	declined_hooks = append(declined_hooks[0:len(declined_hooks):len(declined_hooks)], fn)
+}
+
+// Clears any flash text disturbed by the signal, then notifies hooks that shutdown was declined.
+func shutdownDeclined(s os.Signal) {
+	mutex.Lock()
+	clearFlash()
+	hooks := declined_hooks
+	mutex.Unlock()
+
+	for _, fn := range hooks {
+		fn(s)
+	}
+}
+
 func init() {
 	globalDefer.d_map = make(map[string]func() error)
-	SetSignals(syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM, syscall.SIGHUP)
-	go func() {
-		for {
-			s := <-signalChan
+	globalDefer.names = make(map[string]string)
+	shutdownState.base, shutdownState.cancel = context.WithCancel(context.Background())
+}
 
-			mutex.Lock()
-			cb := callbacks[s]
-			mutex.Unlock()
+// Starts the goroutine that waits on signals and shutdown requests, it is only started once it is needed.
+func startHandler() {
+	handler_once.Do(func() { go handleShutdown() })
+}
 
-			if cb != nil {
-				if !cb() {
-					continue
-				}
-			}
+// Waits for a signal or call to Shutdown, then runs the global defer and exits.
+func handleShutdown() {
+signal_loop:
+	for {
+		var s os.Signal
 
-			atomic.CompareAndSwapInt32(&fatal_triggered, 0, 2)
+		select {
+		case s = <-signalChan:
+		case <-shutdownChan:
+			break signal_loop
+		}
+
+		mutex.Lock()
+		cb := callbacks[s]
+		mutex.Unlock()
 
-			switch s {
-			case syscall.SIGINT:
-				errCode = 130
-			case syscall.SIGHUP:
-				errCode = 129
-			case syscall.SIGTERM:
-				errCode = 143
+		if cb != nil {
+			if !cb() {
+				shutdownDeclined(s)
+				continue
 			}
+		}
 
-			break
+		mutex.Lock()
+		m, ok := signal_messages[s]
+		mutex.Unlock()
+
+		if ok {
+			write2log(m.logger, m.msg)
 		}
 
-		globalDefer.mutex.RLock()
-		defer globalDefer.mutex.RUnlock()
+		atomic.CompareAndSwapInt32(&fatal_triggered, 0, 2)
 
-		// Run through all globalDefer functions.
-		for i := len(globalDefer.ids) - 1; i >= 0; i-- {
-			globalDefer.mutex.RUnlock()
-			if err := globalDefer.d_map[globalDefer.ids[i]](); err != nil {
-				write2log(ERROR|_bypass_lock, err.Error())
-			}
-			globalDefer.mutex.RLock()
+		switch s {
+		case syscall.SIGINT:
+			atomic.StoreInt32(&errCode, 130)
+		case syscall.SIGHUP:
+			atomic.StoreInt32(&errCode, 129)
+		case syscall.SIGTERM:
+			atomic.StoreInt32(&errCode, 143)
 		}
 
-		// Wait on any process that have access to wait.
-		wait.Wait()
+		break
+	}
 
-		// Hide Please Wait
-		PleaseWait.Hide()
+	close(shutdownBegun)
+	ctx, cancel := beginShutdown()
 
-		// Try to flush out any remaining text.
-		write2log(_flash_txt|_no_logging|_bypass_lock, "")
+	globalDefer.mutex.RLock()
+	defer globalDefer.mutex.RUnlock()
 
-		// Finally exit the application
-		select {
-		case exit_lock <- struct{}{}:
-		default:
-			os.Exit(errCode)
+	var report []DeferReport
+	defers_start := time.Now()
+
+	// Run through all globalDefer functions.
+	for i := len(globalDefer.ids) - 1; i >= 0; i-- {
+		d, name := globalDefer.d_map[globalDefer.ids[i]], globalDefer.names[globalDefer.ids[i]]
+		globalDefer.mutex.RUnlock()
+		start := time.Now()
+		err := d()
+		elapsed := time.Since(start)
+		if err != nil {
+			write2log(ERROR|_bypass_lock, err.Error())
 		}
+		write2log(DEBUG|_bypass_lock, "Deferred %s completed in %s.", name, elapsed)
+		report = append(report, DeferReport{name, elapsed, err})
+		globalDefer.mutex.RLock()
+	}
+
+	total := time.Since(defers_start)
+	write2log(DEBUG|_bypass_lock, "All deferred functions completed in %s.", total)
+	if globalDefer.report != nil {
+		globalDefer.report(report, total)
+	}
+
+	// Wait on any process that have access to wait, unless the shutdown deadline passes first.
+	wait_done := make(chan struct{})
+	go func() {
+		wait.Wait()
+		close(wait_done)
 	}()
+	select {
+	case <-wait_done:
+	case <-ctx.Done():
+		write2log(ERROR|_bypass_lock, "Shutdown timeout exceeded, not waiting on remaining tasks.")
+	}
+
+	// Hide Please Wait
+	PleaseWait.Hide()
+
+	logExitSummary()
+	exit_code := int(atomic.LoadInt32(&errCode))
+	logShutdown(exit_code)
+
+	// Try to flush out any remaining text.
+	write2log(_flash_txt|_no_logging|_bypass_lock, "")
+
+	cancel()
+
+	// Finally exit the application
+	select {
+	case exit_lock <- struct{}{}:
+	default:
+		os.Exit(exit_code)
+	}
 }
@@ -0,0 +1,33 @@
+package nfo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBlockShutdownCtx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	BlockShutdownCtx(ctx)
+
+	released := make(chan struct{})
+	go func() {
+		wait.Wait()
+		close(released)
+	}()
+
+	select {
+	case <-released:
+		t.Fatal("shutdown released before the context was cancelled.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the context did not release shutdown.")
+	}
+}
@@ -0,0 +1,82 @@
+package nfo
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Writer that holds on to output until flushed, such as a *bufio.Writer.
+type flusher interface {
+	Flush() error
+}
+
+var flushTicker struct {
+	mutex sync.Mutex
+	close func() error
+}
+
+// Flushes outputs that buffer their writes, such as a *bufio.Writer given to SetOutput, SetFile or AddOutput, at least every d.
+// A final flush is performed at shutdown, a d of 0 stops the ticker.
+func SetFlushInterval(d time.Duration) {
+	flushTicker.mutex.Lock()
+	defer flushTicker.mutex.Unlock()
+
+	// Stop the current ticker, flushing outputs one last time.
+	if flushTicker.close != nil {
+		flushTicker.close()
+		flushTicker.close = nil
+	}
+	if d <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+
+	go func() {
+		t := time.NewTicker(d)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				flushOutputs()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	flushTicker.close = registerDefer("", func() {
+		once.Do(func() { close(stop) })
+		flushOutputs()
+	})
+}
+
+// Flushes all buffered outputs of the default Logger.
+func flushOutputs() {
+	var writers []io.Writer
+
+	std.mutex.Lock()
+	for _, l := range std.l_map {
+		writers = append(writers, l.textout, l.fileout)
+		for _, o := range l.outputs {
+			writers = append(writers, o.w)
+		}
+	}
+	std.mutex.Unlock()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	flushed := make(map[flusher]struct{})
+	for _, w := range writers {
+		if f, ok := w.(flusher); ok {
+			if _, done := flushed[f]; done {
+				continue
+			}
+			flushed[f] = struct{}{}
+			f.Flush()
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package nfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Log entry handed to a Formatter.
+type Record struct {
+	Time    time.Time
+	Logger  uint32
+	Tag     string
+	Prefix  string
+	Message string
+	Err     error // Set for entries logged with LogError.
+
+	LineEnding string // Line ending set with SetLineEnding, Format should end its output with it.
+}
+
+// Formatter renders a Record for an output added with AddOutputFormatted.
+// Format is called while output is locked, so it must not log.
+type Formatter interface {
+	Format(r Record) []byte
+}
+
+// Names of loggers, as used by JSONFormatter.
+var level_names = map[uint32]string{
+	INFO:   "info",
+	ERROR:  "error",
+	WARN:   "warn",
+	NOTICE: "notice",
+	DEBUG:  "debug",
+	TRACE:  "trace",
+	FATAL:  "fatal",
+	AUX:    "aux",
+	AUX2:   "aux2",
+	AUX3:   "aux3",
+	AUX4:   "aux4",
+}
+
+// Renders entries as text lines, with timestamp, tag and prefix.
+type TextFormatter struct{}
+
+func (TextFormatter) Format(r Record) []byte {
+	var out []byte
+	genTS(&out, r.Time)
+	if r.Tag != "" {
+		out = append(out, r.Tag...)
+		out = append(out, ' ')
+	}
+	out = append(out, r.Prefix...)
+	out = append(out, r.Message...)
+	if r.LineEnding == "" {
+		return append(out, '\n')
+	}
+	return append(out, r.LineEnding...)
+}
+
+// Renders entries as JSON objects, one per line.
+// Errors from LogError are included along with each error they wrap.
+type JSONFormatter struct{}
+
+func (JSONFormatter) Format(r Record) []byte {
+	entry := struct {
+		Time    time.Time `json:"time"`
+		Level   string    `json:"level"`
+		Tag     string    `json:"tag,omitempty"`
+		Message string    `json:"message"`
+		Error   string    `json:"error,omitempty"`
+		Chain   []string  `json:"error_chain,omitempty"`
+	}{
+		Time:    r.Time,
+		Level:   level_names[r.Logger],
+		Tag:     r.Tag,
+		Message: r.Message,
+	}
+	if r.Err != nil {
+		entry.Error = r.Err.Error()
+		for err := errors.Unwrap(r.Err); err != nil; err = errors.Unwrap(err) {
+			entry.Chain = append(entry.Chain, err.Error())
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(entry); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
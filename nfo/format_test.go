@@ -0,0 +1,45 @@
+package nfo
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTextFormatterTime(t *testing.T) {
+	r := Record{
+		Time:       time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Prefix:     "[ERROR] ",
+		Message:    "old entry",
+		LineEnding: "\r\n",
+	}
+	want := "[2020/01/02 03:04:05 UTC] [ERROR] old entry\r\n"
+	if got := string(TextFormatter{}.Format(r)); got != want {
+		t.Errorf("Format = %q, want %q.", got, want)
+	}
+}
+
+// Records the line ending handed to it.
+type endingFormatter struct {
+	ending string
+}
+
+func (f *endingFormatter) Format(r Record) []byte {
+	f.ending = r.LineEnding
+	return []byte(r.Message + r.LineEnding)
+}
+
+func TestFormatterLineEnding(t *testing.T) {
+	defer CloseLogging()
+	SetOutput(ALL, None)
+	SetLineEnding("\r\n")
+
+	var buf bytes.Buffer
+	f := new(endingFormatter)
+	AddOutputFormatted(INFO, &buf, f)
+
+	Log("entry")
+	if f.ending != "\r\n" || buf.String() != "entry\r\n" {
+		t.Errorf("formatter saw line ending %q, wrote %q.", f.ending, buf.String())
+	}
+}
@@ -0,0 +1,69 @@
+package nfo
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Time the package was loaded, used for uptime when LogStartup was not called.
+var loaded = time.Now()
+
+var heartbeat struct {
+	mutex sync.Mutex
+	stop  func() error
+}
+
+// Logs uptime, goroutine count and heap usage every interval, as Info unless another logger is specified.
+// The heartbeat stops on shutdown, or when StopHeartbeat is called.
+func StartHeartbeat(interval time.Duration, logger ...uint32) {
+	if interval <= 0 {
+		return
+	}
+	flag := uint32(INFO)
+	if len(logger) > 0 {
+		flag = logger[0]
+	}
+
+	heartbeat.mutex.Lock()
+	defer heartbeat.mutex.Unlock()
+
+	if heartbeat.stop != nil {
+		heartbeat.stop()
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				started := loaded
+				if info, ok := GetStartupInfo(); ok {
+					started = info.Started
+				}
+				var mem runtime.MemStats
+				runtime.ReadMemStats(&mem)
+				write2log(flag, "Heartbeat: uptime %s, %d goroutines, %s heap in use.", time.Since(started).Round(time.Second), runtime.NumGoroutine(), HumanSize(int64(mem.HeapInuse)))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	heartbeat.stop = registerDefer("", func() { once.Do(func() { close(done) }) })
+}
+
+// Stops the heartbeat started by StartHeartbeat.
+func StopHeartbeat() {
+	heartbeat.mutex.Lock()
+	defer heartbeat.mutex.Unlock()
+
+	if heartbeat.stop != nil {
+		heartbeat.stop()
+		heartbeat.stop = nil
+	}
+}
@@ -0,0 +1,691 @@
+package nfo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Logger is a set of loggers with its own outputs, prefixes, timezone, syslog export, tag, line ending,
+// message length limit, audit file, sampling and stats. The package level functions use a default Logger writing to standard out.
+// Flash text, stack traces, the clock, FatalOnFileError and FatalOnExportError, and Fatal and shutdown handling are shared by all loggers.
+type Logger struct {
+	mutex       sync.Mutex
+	l_map       map[uint32]*_logger
+	exports     uint32
+	syslog      SyslogWriter
+	timezone    *time.Location
+	hooks       []func(logger uint32, err error)
+	tag         string
+	compact     bool
+	max_message int
+	line_ending string
+	audit       auditLog
+	sampling    map[uint32]*sampler
+	stats       map[uint32]*uint64
+}
+
+type _logger struct {
+	prefix  string
+	textout io.Writer
+	fileout io.Writer
+	use_ts  bool
+	outputs []extOutput
+}
+
+// An additional output, entries are rendered by format when set.
+type extOutput struct {
+	w      io.Writer
+	format Formatter
+}
+
+// Default Logger used by package level functions.
+var std = &Logger{
+	l_map:       stdLoggers(),
+	exports:     STD,
+	timezone:    time.Local,
+	line_ending: "\n",
+	stats:       newStats(),
+}
+
+// Returns loggers of the default Logger, as configured at start.
+func stdLoggers() map[uint32]*_logger {
+	return map[uint32]*_logger{
+		INFO:        {"", os.Stdout, None, true, nil},
+		AUX:         {"", os.Stdout, None, true, nil},
+		AUX2:        {"", os.Stdout, None, true, nil},
+		AUX3:        {"", os.Stdout, None, true, nil},
+		AUX4:        {"", os.Stdout, None, true, nil},
+		ERROR:       {"[ERROR] ", os.Stdout, None, true, nil},
+		WARN:        {"[WARN] ", os.Stdout, None, true, nil},
+		NOTICE:      {"[NOTICE] ", os.Stdout, None, true, nil},
+		DEBUG:       {"[DEBUG] ", None, None, true, nil},
+		TRACE:       {"[TRACE] ", None, None, true, nil},
+		FATAL:       {"[FATAL] ", os.Stdout, None, true, nil},
+		_flash_txt:  {"", os.Stderr, None, false, nil},
+		_print_txt:  {"", os.Stdout, None, false, nil},
+		_stderr_txt: {"", os.Stderr, None, false, nil},
+	}
+}
+
+// Creates a new Logger independent of the package level functions, standard loggers write to w with timestamps.
+// Debug and Trace are discarded until given an output with SetOutput.
+func New(w io.Writer) *Logger {
+	return &Logger{
+		l_map: map[uint32]*_logger{
+			INFO:   {"", w, None, true, nil},
+			AUX:    {"", w, None, true, nil},
+			AUX2:   {"", w, None, true, nil},
+			AUX3:   {"", w, None, true, nil},
+			AUX4:   {"", w, None, true, nil},
+			ERROR:  {"[ERROR] ", w, None, true, nil},
+			WARN:   {"[WARN] ", w, None, true, nil},
+			NOTICE: {"[NOTICE] ", w, None, true, nil},
+			DEBUG:  {"[DEBUG] ", None, None, true, nil},
+			TRACE:  {"[TRACE] ", None, None, true, nil},
+			FATAL:  {"[FATAL] ", w, None, true, nil},
+		},
+		exports:     STD,
+		timezone:    time.Local,
+		line_ending: "\n",
+		stats:       newStats(),
+	}
+}
+
+// Retrieve first matching logger.
+func (L *Logger) getLogger(flag uint32) *_logger {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	for k, v := range L.l_map {
+		if flag&k == k {
+			return v
+		}
+	}
+	return nil
+}
+
+// Updates logger.
+func (L *Logger) updateLogger(flag uint32, field uint32, input interface{}) {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	for k, v := range L.l_map {
+		if flag&k == k {
+			switch field {
+			case textWriter:
+				if x, ok := input.(io.Writer); ok {
+					v.textout = x
+				} else {
+					return
+				}
+			case fileWriter:
+				if x, ok := input.(io.WriteCloser); ok {
+					v.fileout = x
+				} else {
+					return
+				}
+			case setTimestamp:
+				if x, ok := input.(bool); ok {
+					v.use_ts = x
+				} else {
+					return
+				}
+			case addOutput:
+				if x, ok := input.(extOutput); ok {
+					v.outputs = append(v.outputs[0:len(v.outputs):len(v.outputs)], x)
+				} else {
+					return
+				}
+			case setPrefix:
+				if x, ok := input.(string); ok {
+					v.prefix = x
+				} else {
+					return
+				}
+			default:
+				return
+			}
+		}
+	}
+}
+
+// Returns log output for text.
+func (L *Logger) GetOutput(flag uint32) io.Writer {
+	t := L.getLogger(flag)
+	if t == nil {
+		return nil
+	}
+	return t.textout
+}
+
+// Returns log file output.
+func (L *Logger) GetFile(flag uint32) io.Writer {
+	t := L.getLogger(flag)
+	if t == nil {
+		return nil
+	}
+	return t.fileout
+}
+
+// Enable Timestamp on output.
+func (L *Logger) ShowTS(flag ...uint32) {
+	if len(flag) == 0 {
+		flag = append(flag, ALL)
+	}
+	L.updateLogger(flag[0], setTimestamp, true)
+}
+
+// Disable Timestamp on output.
+func (L *Logger) HideTS(flag ...uint32) {
+	if len(flag) == 0 {
+		flag = append(flag, ALL)
+	}
+	L.updateLogger(flag[0], setTimestamp, false)
+}
+
+// Enable a specific logger.
+func (L *Logger) SetOutput(flag uint32, w io.Writer) {
+	L.updateLogger(flag, textWriter, w)
+}
+
+// Sets file output for a specific logger.
+func (L *Logger) SetFile(flag uint32, input io.Writer) {
+	L.updateLogger(flag, fileWriter, input)
+}
+
+// Adds w as an additional output of the specified loggers, alongside those set by SetOutput and SetFile.
+// Entries are written to w as they are written to log files, with timestamps.
+func (L *Logger) AddOutput(flag uint32, w io.Writer) {
+	L.updateLogger(flag, addOutput, extOutput{w, nil})
+}
+
+// Adds w as an additional output of the specified loggers, with each entry rendered by format.
+func (L *Logger) AddOutputFormatted(flag uint32, w io.Writer, format Formatter) {
+	L.updateLogger(flag, addOutput, extOutput{w, format})
+}
+
+// Change prefix for specified logger.
+func (L *Logger) SetPrefix(logger uint32, prefix_str string) {
+	L.updateLogger(logger, setPrefix, prefix_str)
+}
+
+// Sets a tag to place at the start of every log entry, such as "[svc-1]" to identify the instance in aggregated logs.
+func (L *Logger) SetGlobalTag(tag string) {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	L.tag = tag
+}
+
+// Replaces logger prefixes with single character level indicators, ie.. "W " rather than "[WARN] ".
+// JSON output is unaffected.
+func (L *Logger) SetCompactLevels(enable bool) {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	L.compact = enable
+}
+
+// Truncates log entries longer than n bytes, noting how many bytes were left out. Fatal entries are never truncated.
+// Setting n to 0 disables truncation, which is the default.
+func (L *Logger) SetMaxMessageLength(n int) {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	L.max_message = n
+}
+
+// Sets the line ending written after each entry, such as "\r\n" for Windows log consumers. (Default "\n")
+func (L *Logger) SetLineEnding(ending string) {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	L.line_ending = ending
+}
+
+// Specify which logs to send to syslog.
+func (L *Logger) EnableExport(flag uint32) {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	L.exports = L.exports | flag
+}
+
+// Specific which logger to not export.
+func (L *Logger) DisableExport(flag uint32) {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	L.exports = L.exports & ^flag
+}
+
+// Send messages to syslog
+func (L *Logger) HookSyslog(syslog_writer SyslogWriter) {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	L.syslog = syslog_writer
+}
+
+// Disconnect form syslog
+func (L *Logger) UnhookSyslog() {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	L.syslog = nil
+}
+
+// Sets timezone of timestamps to location.
+func (L *Logger) SetTZ(location string) (err error) {
+	tz, err := time.LoadLocation(location)
+	if err != nil {
+		return err
+	}
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	L.timezone = tz
+	return
+}
+
+// Switches timestamps to local timezone. (Default Setting)
+func (L *Logger) LTZ() {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	L.timezone = time.Local
+}
+
+// Switches logger to use UTC instead of local timezone.
+func (L *Logger) UTC() {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	L.timezone = time.UTC
+}
+
+// Log as Info.
+func (L *Logger) Log(vars ...interface{}) {
+	L.write(INFO, vars...)
+}
+
+// Log as Error.
+func (L *Logger) Err(vars ...interface{}) {
+	L.write(ERROR, vars...)
+}
+
+// Log as Warn.
+func (L *Logger) Warn(vars ...interface{}) {
+	L.write(WARN, vars...)
+}
+
+// Log as Notice.
+func (L *Logger) Notice(vars ...interface{}) {
+	L.write(NOTICE, vars...)
+}
+
+// Log as Info, as auxiliary output.
+func (L *Logger) Aux(vars ...interface{}) {
+	L.write(AUX, vars...)
+}
+
+// Log as Info, as auxiliary output.
+func (L *Logger) Aux2(vars ...interface{}) {
+	L.write(AUX2, vars...)
+}
+
+// Log as Info, as auxiliary output.
+func (L *Logger) Aux3(vars ...interface{}) {
+	L.write(AUX3, vars...)
+}
+
+// Log as Info, as auxiliary output.
+func (L *Logger) Aux4(vars ...interface{}) {
+	L.write(AUX4, vars...)
+}
+
+// Log as Debug.
+func (L *Logger) Debug(vars ...interface{}) {
+	L.write(DEBUG, vars...)
+}
+
+// Log as Trace.
+func (L *Logger) Trace(vars ...interface{}) {
+	L.write(TRACE, vars...)
+}
+
+// Log msg and err to logger, then pass err to functions registered with HookErrors.
+// The original err is handed to hooks, so they may inspect it with errors.Is and errors.As.
+func (L *Logger) LogError(logger uint32, err error, msg string) {
+	if err == nil {
+		return
+	}
+	if msg == "" {
+		L.writeErr(logger, err, err)
+	} else {
+		L.writeErr(logger, err, "%s: %s", msg, err)
+	}
+	L.runHooks(logger, err)
+}
+
+// Passes err to functions registered with HookErrors.
+func (L *Logger) runHooks(logger uint32, err error) {
+	L.mutex.Lock()
+	hooks := L.hooks
+	L.mutex.Unlock()
+	for _, fn := range hooks {
+		fn(logger, err)
+	}
+}
+
+// Registers fn to be called with each error logged through LogError.
+func (L *Logger) HookErrors(fn func(logger uint32, err error)) {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	L.hooks = append(L.hooks[0:len(L.hooks):len(L.hooks)], fn)
+}
+
+// Returns true if entries to logger would be written anywhere.
+func (L *Logger) enabled(flag uint32) bool {
+	L.mutex.Lock()
+	l, ok := L.l_map[flag]
+	if !ok {
+		L.mutex.Unlock()
+		return false
+	}
+	defer L.mutex.Unlock()
+	if l.textout != None || l.fileout != None || len(l.outputs) > 0 || L.syslog != nil && L.exports&flag == flag {
+		return true
+	}
+	return L.audit.file != nil && L.audit.flags&flag == flag
+}
+
+// Log to logger with text from fn, fn is only called if the logger has somewhere to write to.
+func (L *Logger) LogLazy(logger uint32, fn func() string) {
+	if L.enabled(logger) {
+		L.write(logger, fn())
+	}
+}
+
+// Log as Debug with text from fn, fn is only called if debug output is enabled.
+func (L *Logger) DebugLazy(fn func() string) {
+	L.LogLazy(DEBUG, fn)
+}
+
+// Log as Trace with text from fn, fn is only called if trace output is enabled.
+func (L *Logger) TraceLazy(fn func() string) {
+	L.LogLazy(TRACE, fn)
+}
+
+// Log as Fatal, then quit.
+func (L *Logger) Fatal(vars ...interface{}) {
+	if atomic.CompareAndSwapInt32(&fatal_triggered, 0, 1) {
+		// Defer fatal output, so it is the last log entry displayed.
+		L.write(FATAL|_bypass_lock, vars...)
+		atomic.StoreInt32(&errCode, 1)
+		startHandler()
+		signalChan <- os.Kill
+		<-exit_lock
+		os.Exit(1)
+	} else {
+		// Catch any other fatals and just let them sit.
+		halt := make(chan struct{})
+		<-halt
+	}
+}
+
+// Time source for timestamps.
+var clock = time.Now
+
+// Replaces the time source used for timestamps, intended for tests that need predictable output.
+// Passing nil restores time.Now.
+func SetClock(fn func() time.Time) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if fn == nil {
+		fn = time.Now
+	}
+	clock = fn
+}
+
+// Generate TS Bytes for time CT.
+func genTS(in *[]byte, CT time.Time) {
+
+	year, mon, day := CT.Date()
+	hour, min, sec := CT.Clock()
+
+	ts := in
+
+	*ts = append(*ts, '[')
+	Itoa(ts, year, 4)
+	*ts = append(*ts, '/')
+	Itoa(ts, int(mon), 2)
+	*ts = append(*ts, '/')
+	Itoa(ts, day, 2)
+	*ts = append(*ts, ' ')
+	Itoa(ts, hour, 2)
+	*ts = append(*ts, ':')
+	Itoa(ts, min, 2)
+	*ts = append(*ts, ':')
+	Itoa(ts, sec, 2)
+	*ts = append(*ts, ' ')
+
+	zone, _ := CT.Zone()
+	*ts = append(*ts, []byte(zone)[0:]...)
+	*ts = append(*ts, []byte("] ")[0:]...)
+}
+
+// Removes flash text from the terminal, mutex must be held by caller.
+func clearFlash() {
+	if !flush_needed || piped_flash {
+		return
+	}
+	if flush_line_len < last_flash_len {
+		for i := len(flush_line); i < last_flash_len; i++ {
+			flush_line_len++
+			flush_line = append(flush_line[0:], ' ')
+		}
+	}
+	fmt.Fprintf(flash_out, "\r%s\r", string(flush_line[0:last_flash_len]))
+	flush_needed = false
+}
+
+// Prepares output text and sends to appropriate logging destinations.
+func (L *Logger) write(flag uint32, vars ...interface{}) {
+	L.writeErr(flag, nil, vars...)
+}
+
+// Prepares output text and sends to appropriate logging destinations, err is passed along to formatted outputs.
+func (L *Logger) writeErr(flag uint32, log_err error, vars ...interface{}) {
+
+	if atomic.LoadInt32(&fatal_triggered) == 1 {
+		if flag&_bypass_lock != 0 {
+			flag ^= _bypass_lock
+		} else {
+			return
+		}
+	}
+
+	sampled := flag&_no_sampling == 0
+	flag = flag &^ (_bypass_lock | _no_sampling)
+
+	// Copy logger settings, so output isn't held up by configuration changes.
+	L.mutex.Lock()
+	l, ok := L.l_map[flag&^(_no_logging|_raw_txt)]
+	if !ok {
+		L.mutex.Unlock()
+		return
+	}
+	logger := *l
+	timezone := L.timezone
+	exports := L.exports
+	export_syslog := L.syslog
+	tag := L.tag
+	compact := L.compact
+	max_message := L.max_message
+	line_ending := L.line_ending
+	L.mutex.Unlock()
+
+	if flag&_no_logging == 0 && sampled {
+		keep, dropped := L.sample(flag)
+		if !keep {
+			return
+		}
+		if dropped > 0 {
+			L.writeErr(flag|_no_sampling, nil, fmt.Sprintf("%d messages dropped by sampling.", dropped))
+		}
+		L.countLog(flag)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if compact {
+		if c, ok := compact_prefix[flag&^(_no_logging|_raw_txt)]; ok {
+			logger.prefix = c
+		}
+	}
+
+	var pre []byte
+
+	if flag&_no_logging != _no_logging {
+		if logger.use_ts {
+			genTS(&pre, clock().In(timezone))
+		}
+		if tag != "" {
+			pre = append(pre, tag...)
+			pre = append(pre, ' ')
+		}
+		pre = append(pre, []byte(logger.prefix)[0:]...)
+	}
+
+	// Reset buffer.
+	msgBuffer.Reset()
+
+	// Create output string.
+	fprintf(&msgBuffer, vars...)
+
+	// Truncate oversized entries, fatal entries are always kept in full.
+	if max_message > 0 && msgBuffer.Len() > max_message && flag&(FATAL|_no_logging) == 0 {
+		n := max_message
+		for n > 0 && !utf8.RuneStart(msgBuffer.Bytes()[n]) {
+			n--
+		}
+		omitted := msgBuffer.Len() - n
+		msgBuffer.Truncate(n)
+		fmt.Fprintf(&msgBuffer, "…(truncated, %d bytes omitted)", omitted)
+	}
+
+	// Copy original output for export.
+	msg := msgBuffer.String()
+
+	output := msgBuffer.Bytes()
+	output = append(pre, output[0:]...)
+	bufferLen := len(output)
+
+	if flag&(_raw_txt|_flash_txt) == 0 {
+		output = bytes.TrimSuffix(output, []byte{'\n'})
+		output = bytes.TrimSuffix(output, []byte{'\r'})
+		if stack_levels&flag != 0 && flag&_no_logging == 0 {
+			output = append(output, callerStack(line_ending)...)
+		}
+		output = append(output, line_ending...)
+	}
+
+	// Clear out last flash text.
+	if flush_needed && ((logger.textout == os.Stdout && !piped_stdout) || logger.textout == os.Stderr || logger.textout == flash_out) {
+		clearFlash()
+	}
+
+	last_line = bufferLen
+
+	// Flash text handler, make a line of text available to remove remnents of this text.
+	if flag&_flash_txt != 0 {
+		if !piped_flash && !flash_disabled {
+			width := termWidth()
+			if utf8.RuneCount(output) > width {
+				output = output[0:width]
+			}
+			io.Copy(flash_out, bytes.NewReader(output))
+			flush_needed = true
+			last_flash_len = len(output)
+			return
+		}
+		return
+	}
+
+	io.Copy(logger.textout, bytes.NewReader(output))
+	if flag&_no_logging != 0 {
+		return
+	}
+
+	// Preprend timestamp for file.
+	if !logger.use_ts {
+		out_len := len(output)
+		genTS(&output, clock().In(timezone))
+		out := output[out_len:]
+		out = append(out, output[0:out_len]...)
+		output = out
+	}
+
+	// Write to file.
+	_, err := io.Copy(logger.fileout, bytes.NewReader(output))
+	// Launch fatal in a go routine, as the mutex is currently locked.
+	if err != nil && FatalOnFileError {
+		go Fatal(err)
+	}
+
+	// Write to additional outputs.
+	for _, o := range logger.outputs {
+		entry := output
+		if o.format != nil {
+			entry = o.format.Format(Record{
+				Time:    clock().In(timezone),
+				Logger:  flag,
+				Tag:     tag,
+				Prefix:  logger.prefix,
+				Message: strings.TrimRight(msg, "\r\n"),
+				Err:     log_err,
+
+				LineEnding: line_ending,
+			})
+		}
+		if _, err = o.w.Write(entry); err != nil && FatalOnFileError {
+			go Fatal(err)
+		}
+	}
+
+	// Write to audit file.
+	if err = L.writeAudit(flag, output); err != nil && FatalOnFileError {
+		go Fatal(err)
+	}
+
+	if export_syslog != nil && exports&flag == flag {
+		switch flag {
+		case INFO:
+			fallthrough
+		case AUX:
+			fallthrough
+		case AUX2:
+			fallthrough
+		case AUX3:
+			fallthrough
+		case AUX4:
+			err = export_syslog.Info(msg)
+		case ERROR:
+			err = export_syslog.Err(msg)
+		case WARN:
+			err = export_syslog.Warning(msg)
+		case FATAL:
+			err = export_syslog.Emerg(msg)
+		case NOTICE:
+			err = export_syslog.Notice(msg)
+		case DEBUG:
+			err = export_syslog.Debug(msg)
+		case TRACE:
+			err = export_syslog.Debug(msg)
+		}
+		if err != nil && FatalOnExportError {
+			go Fatal(err)
+		}
+	}
+}
+
+// Prepares output text and sends to appropriate logging destinations of the default Logger.
+func write2log(flag uint32, vars ...interface{}) {
+	std.write(flag, vars...)
+}
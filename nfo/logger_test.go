@@ -0,0 +1,100 @@
+package nfo
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoggerIndependent(t *testing.T) {
+	defer CloseLogging()
+
+	var std_out, a_out, b_out bytes.Buffer
+	SetOutput(ALL, &std_out)
+
+	a, b := New(&a_out), New(&b_out)
+	a.SetGlobalTag("[a]")
+	a.SetLineEnding("\r\n")
+	a.SetSampling(INFO, 2)
+	b.SetMaxMessageLength(4)
+
+	audit := filepath.Join(t.TempDir(), "audit.log")
+	if err := a.SetAuditLog(audit, ALL); err != nil {
+		t.Fatal(err)
+	}
+
+	before := Stats()[INFO]
+	for i := 0; i < 4; i++ {
+		a.Log("sampled")
+	}
+	b.Log("truncated")
+	Log("default")
+
+	if got := strings.Count(a_out.String(), "[a] sampled\r\n"); got != 2 {
+		t.Errorf("a wrote %q, want 2 tagged entries ending in \\r\\n.", a_out.String())
+	}
+	if got := a.SampledDrops(INFO); got != 2 {
+		t.Errorf("a dropped %d entries, want 2.", got)
+	}
+	if got := a.Stats()[INFO]; got != 2 {
+		t.Errorf("a counted %d entries, want 2.", got)
+	}
+	if !strings.Contains(b_out.String(), "] trun…(truncated") || strings.Contains(b_out.String(), "[a]") {
+		t.Errorf("b wrote %q, want a truncated untagged entry.", b_out.String())
+	}
+	if std_out.String() != "default\n" {
+		t.Errorf("default logger wrote %q, want only its own entry.", std_out.String())
+	}
+	if got := Stats()[INFO] - before; got != 1 {
+		t.Errorf("default logger counted %d entries, want 1.", got)
+	}
+
+	data, err := os.ReadFile(audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "default") || strings.Contains(string(data), "truncated") || !strings.Contains(string(data), "sampled") {
+		t.Errorf("audit file of a holds %q, want only entries of a.", data)
+	}
+}
+
+func TestLineEndingFile(t *testing.T) {
+	defer CloseLogging()
+
+	file := filepath.Join(t.TempDir(), "test.log")
+	f, err := LogFile(file, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetOutput(ALL, None)
+	SetFile(ALL, f.(io.WriteCloser))
+	SetLineEnding("\r\n")
+	SetStackTrace(ERROR)
+
+	Log("first")
+	Warn("second\n")
+	Err("third")
+	CloseLogging()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\r\n")
+	if len(lines) < 4 || lines[len(lines)-1] != "" {
+		t.Fatalf("file holds %q, want every line ended by \\r\\n.", data)
+	}
+	for _, line := range lines[:len(lines)-1] {
+		if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "\r\n") {
+			t.Errorf("line %q not ended by a single \\r\\n.", line)
+		}
+	}
+	for i, want := range []string{"] first\r\n", "] [WARN] second\r\n", "] [ERROR] third\r\n"} {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Errorf("line %d = %q, want it to end with %q.", i+1, lines[i], want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package nfo
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	net_buffer   = 1024            // Entries held while the endpoint is unreachable.
+	net_attempts = 3               // Attempts to deliver an entry before writing it to standard error.
+	net_timeout  = 5 * time.Second // Timeout for connecting and writing.
+)
+
+// Output sending entries to a network endpoint, entries are queued so logging is never held up by the network.
+type netWriter struct {
+	network string
+	address string
+	mutex   sync.Mutex
+	closed  bool
+	queue   chan []byte
+	done    chan struct{}
+}
+
+func (N *netWriter) Write(p []byte) (int, error) {
+	N.mutex.Lock()
+	defer N.mutex.Unlock()
+	if N.closed {
+		return len(p), nil
+	}
+	select {
+	case N.queue <- append([]byte(nil), p...):
+	default:
+		// Queue is full, make room by dropping the oldest entry.
+		select {
+		case <-N.queue:
+		default:
+		}
+		N.queue <- append([]byte(nil), p...)
+	}
+	return len(p), nil
+}
+
+// Delivers queued entries, reconnecting as needed.
+func (N *netWriter) run(conn net.Conn) {
+	defer close(N.done)
+
+	var reported bool
+
+	for entry := range N.queue {
+		var err error
+		for attempt := 0; attempt < net_attempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			if conn == nil {
+				if conn, err = net.DialTimeout(N.network, N.address, net_timeout); err != nil {
+					conn = nil
+					continue
+				}
+			}
+			conn.SetWriteDeadline(time.Now().Add(net_timeout))
+			if _, err = conn.Write(entry); err != nil {
+				conn.Close()
+				conn = nil
+				continue
+			}
+			break
+		}
+		if err == nil {
+			reported = false
+			continue
+		}
+		// Endpoint is unavailable, keep the entry on standard error and report the outage once.
+		os.Stderr.Write(entry)
+		if !reported {
+			reported = true
+			err = fmt.Errorf("Network log output %s://%s unavailable: %w", N.network, N.address, err)
+			write2log(_stderr_txt|_no_logging, err.Error()+"\n")
+			std.runHooks(ERROR, err)
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Stops accepting entries and delivers what is queued, or gives up once ctx is done.
+func (N *netWriter) Close(ctx context.Context) error {
+	N.mutex.Lock()
+	if !N.closed {
+		N.closed = true
+		close(N.queue)
+	}
+	N.mutex.Unlock()
+
+	select {
+	case <-N.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Sends entries of the standard loggers to a network endpoint, such as ("tcp", "logs.example:5000") or ("unix", "/run/log.sock").
+// Entries are queued and sent in the background, reconnecting when the connection drops.
+// Entries that can't be delivered are written to standard error, and the outage is passed to functions registered with HookErrors.
+func SetNetworkOutput(network, address string) error {
+	conn, err := net.DialTimeout(network, address, net_timeout)
+	if err != nil {
+		return err
+	}
+	N := &netWriter{
+		network: network,
+		address: address,
+		queue:   make(chan []byte, net_buffer),
+		done:    make(chan struct{}),
+	}
+	go N.run(conn)
+	AddOutput(STD, N)
+	registerDefer("", N.Close)
+	return nil
+}
@@ -1,5 +1,8 @@
 // Package 'nfo' is a simple central logging library with file log rotation as well as exporting to syslog.
 // Additionally it provides a global defer for cleanly exiting applications and performing last minute tasks before application exits.
+// OS signals are only captured once the application puts the global defer to use, by Defer, DeferServer, BlockShutdown, WaitForShutdown,
+// SignalCallback or SetSignals, or by a prompt such as GetSecret that must restore the terminal. Files and tickers nfo defers itself,
+// such as those of LogFile, SetAuditLog, SetNetworkOutput, SetFlushInterval and StartHeartbeat, are closed at shutdown without capturing signals.
 
 package nfo
 
@@ -13,9 +16,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
-	"unicode/utf8"
 )
 
 const (
@@ -35,6 +36,8 @@ const (
 	_stderr_txt
 	_bypass_lock
 	_no_logging
+	_raw_txt
+	_no_sampling
 )
 
 // Standard Loggers, minus debug and trace.
@@ -43,11 +46,28 @@ const (
 	ALL = INFO | ERROR | WARN | NOTICE | FATAL | AUX | AUX2 | AUX3 | AUX4 | DEBUG | TRACE
 )
 
+// Loggers ordered by severity, from least to most severe.
+var severity = []uint32{TRACE, DEBUG, INFO | AUX | AUX2 | AUX3 | AUX4, NOTICE, WARN, ERROR, FATAL}
+
+// Returns loggers of the same or greater severity than logger, ie.. AtLeast(WARN) returns WARN|ERROR|FATAL.
+func AtLeast(logger uint32) (flag uint32) {
+	for i, v := range severity {
+		if v&logger != 0 {
+			for _, v := range severity[i:] {
+				flag |= v
+			}
+			return
+		}
+	}
+	return
+}
+
 const (
 	textWriter = 1 << iota
 	fileWriter
 	setTimestamp
 	setPrefix
+	addOutput
 )
 
 var (
@@ -59,29 +79,14 @@ var (
 	last_flash_len     int
 	last_line          int
 	flush_needed       bool
+	flash_disabled     bool
 	piped_stdout       bool
 	piped_stderr       bool
+	piped_flash        bool
+	flash_out          io.Writer = os.Stderr
 	fatal_triggered    int32
 	msgBuffer          bytes.Buffer
-	enabled_exports    = uint32(STD)
 	mutex              sync.Mutex
-	timezone           = time.Local
-	l_map              = map[uint32]*_logger{
-		INFO:        {"", os.Stdout, None, true},
-		AUX:         {"", os.Stdout, None, true},
-		AUX2:        {"", os.Stdout, None, true},
-		AUX3:        {"", os.Stdout, None, true},
-		AUX4:        {"", os.Stdout, None, true},
-		ERROR:       {"[ERROR] ", os.Stdout, None, true},
-		WARN:        {"[WARN] ", os.Stdout, None, true},
-		NOTICE:      {"[NOTICE] ", os.Stdout, None, true},
-		DEBUG:       {"[DEBUG] ", None, None, true},
-		TRACE:       {"[TRACE] ", None, None, true},
-		FATAL:       {"[FATAL] ", os.Stdout, None, true},
-		_flash_txt:  {"", os.Stderr, None, false},
-		_print_txt:  {"", os.Stdout, None, false},
-		_stderr_txt: {"", os.Stderr, None, false},
-	}
 )
 
 func init() {
@@ -91,16 +96,10 @@ func init() {
 	if !terminal.IsTerminal(int(os.Stderr.Fd())) {
 		piped_stderr = true
 	}
+	piped_flash = piped_stderr
 	HideTS()
 }
 
-type _logger struct {
-	prefix  string
-	textout io.Writer
-	fileout io.Writer
-	use_ts  bool
-}
-
 // Creates folders.
 func mkDir(name ...string) (err error) {
 	for _, path := range name {
@@ -129,18 +128,82 @@ func mkDir(name ...string) (err error) {
 // Opens a new log file for writing, max_size is threshold for rotation, max_rotation is number of previous logs to hold on to.
 // Set max_size_mb to 0 to disable file rotation.
 func LogFile(filename string, max_size_mb uint, max_rotation uint) (io.Writer, error) {
+	file, _, err := openLogFile(filename, max_size_mb, max_rotation)
+	return file, err
+}
+
+// Opens a log file as LogFile does, also returning the function that closes it.
+func openLogFile(filename string, max_size_mb uint, max_rotation uint) (io.Writer, func() error, error) {
 	max_size := int64(max_size_mb * 1048576)
 	fpath, _ := filepath.Split(filename)
 
 	if err := mkDir(fpath); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	file, err := wrotate.OpenFile(filename, max_size, max_rotation)
-	if err == nil {
-		Defer(file.Close)
+	if err != nil {
+		return nil, nil, err
 	}
-	return file, err
+
+	var once sync.Once
+	d := registerDefer("", file.Close)
+	close := func() (err error) {
+		once.Do(func() { err = d() })
+		return
+	}
+	mutex.Lock()
+	log_files = append(log_files, close)
+	mutex.Unlock()
+	return file, close, nil
+}
+
+// Closers of files opened by LogFile, each only closes its file once.
+var log_files []func() error
+
+// Flushes and closes all log and audit files, then restores the package level loggers to their initial settings.
+// Allows logging to be torn down and reconfigured, such as between tests or when unloading a plugin.
+func CloseLogging() (err error) {
+	SetFlushInterval(0)
+	flushOutputs()
+
+	std.mutex.Lock()
+	std.l_map = stdLoggers()
+	std.exports = STD
+	std.syslog = nil
+	std.hooks = nil
+	std.timezone = time.Local
+	std.tag = ""
+	std.compact = false
+	std.max_message = 0
+	std.line_ending = "\n"
+	std.sampling = nil
+	audit_close := std.audit.close
+	std.audit = auditLog{}
+	std.mutex.Unlock()
+	HideTS()
+
+	mutex.Lock()
+	closers := log_files
+	log_files = nil
+	configured.file, configured.size, configured.count = "", 0, 0
+	configured.w, configured.close, configured.level, configured.hidden = nil, nil, 0, nil
+	if audit_close != nil {
+		closers = append(closers, audit_close)
+	}
+	stack_levels = 0
+	caller_skip = 0
+	flash_disabled = false
+	mutex.Unlock()
+
+	SetFlashOutput(os.Stderr)
+
+	for _, close := range closers {
+		if e := close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
 }
 
 // False writer for discarding output.
@@ -152,163 +215,73 @@ func (dummyWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-// Retrieve first matching logger.
-func getLogger(flag uint32) *_logger {
-	mutex.Lock()
-	defer mutex.Unlock()
-	for k, v := range l_map {
-		if flag&k == k {
-			return v
-		}
-	}
-	return nil
-}
-
-// Updates logger.
-func updateLogger(flag uint32, field uint32, input interface{}) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	for k, v := range l_map {
-		if flag&k == k {
-			switch field {
-			case textWriter:
-				if x, ok := input.(io.Writer); ok {
-					v.textout = x
-				} else {
-					return
-				}
-			case fileWriter:
-				if x, ok := input.(io.WriteCloser); ok {
-					v.fileout = x
-				} else {
-					return
-				}
-			case setTimestamp:
-				if x, ok := input.(bool); ok {
-					v.use_ts = x
-				} else {
-					return
-				}
-			case setPrefix:
-				if x, ok := input.(string); ok {
-					v.prefix = x
-				} else {
-					return
-				}
-			default:
-				return
-			}
-		}
-	}
-}
-
 // Returns log output for text.
 func GetOutput(flag uint32) io.Writer {
-	t := getLogger(flag)
-	return t.textout
+	return std.GetOutput(flag)
 }
 
 // Returns log file output.
 func GetFile(flag uint32) io.Writer {
-	t := getLogger(flag)
-	return t.fileout
+	return std.GetFile(flag)
 }
 
 // Enable Timestamp on output.
 func ShowTS(flag ...uint32) {
-	if len(flag) == 0 {
-		flag = append(flag, ALL)
-	}
-	updateLogger(flag[0], setTimestamp, true)
+	std.ShowTS(flag...)
 }
 
 // Disable Timestamp on output.
 func HideTS(flag ...uint32) {
-	if len(flag) == 0 {
-		flag = append(flag, ALL)
-	}
-	updateLogger(flag[0], setTimestamp, false)
+	std.HideTS(flag...)
 }
 
 // Enable a specific logger.
 func SetOutput(flag uint32, w io.Writer) {
-	updateLogger(flag, textWriter, w)
+	std.SetOutput(flag, w)
 }
 
 func SetFile(flag uint32, input io.Writer) {
-	updateLogger(flag, fileWriter, input)
+	std.SetFile(flag, input)
+}
+
+// Adds w as an additional output of the specified loggers, ie.. AddOutput(AtLeast(WARN), os.Stderr).
+// Entries are written to w as they are written to log files, with timestamps.
+func AddOutput(flag uint32, w io.Writer) {
+	std.AddOutput(flag, w)
+}
+
+// Adds w as an additional output of the specified loggers, with each entry rendered by format.
+func AddOutputFormatted(flag uint32, w io.Writer, format Formatter) {
+	std.AddOutputFormatted(flag, w, format)
 }
 
 // Specify which logs to send to syslog.
 func EnableExport(flag uint32) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	enabled_exports = enabled_exports | flag
+	std.EnableExport(flag)
 }
 
 // Specific which logger to not export.
 func DisableExport(flag uint32) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	enabled_exports = enabled_exports & ^flag
+	std.DisableExport(flag)
 }
 
 func SetTZ(location string) (err error) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	tz := timezone
-	timezone, err = time.LoadLocation(location)
-	if err != nil {
-		timezone = tz
-	}
-	return
+	return std.SetTZ(location)
 }
 
 // Switches timestamps to local timezone. (Default Setting)
 func LTZ() {
-	mutex.Lock()
-	defer mutex.Unlock()
-	timezone = time.Local
+	std.LTZ()
 }
 
 // Switches logger to use UTC instead of local timezone.
 func UTC() {
-	mutex.Lock()
-	defer mutex.Unlock()
-	timezone = time.UTC
-}
-
-// Generate TS Bytes
-func genTS(in *[]byte) {
-	CT := time.Now().In(timezone)
-
-	year, mon, day := CT.Date()
-	hour, min, sec := CT.Clock()
-
-	ts := in
-
-	*ts = append(*ts, '[')
-	Itoa(ts, year, 4)
-	*ts = append(*ts, '/')
-	Itoa(ts, int(mon), 2)
-	*ts = append(*ts, '/')
-	Itoa(ts, day, 2)
-	*ts = append(*ts, ' ')
-	Itoa(ts, hour, 2)
-	*ts = append(*ts, ':')
-	Itoa(ts, min, 2)
-	*ts = append(*ts, ':')
-	Itoa(ts, sec, 2)
-	*ts = append(*ts, ' ')
-
-	zone, _ := CT.Zone()
-	*ts = append(*ts, []byte(zone)[0:]...)
-	*ts = append(*ts, []byte("] ")[0:]...)
+	std.UTC()
 }
 
 // Change prefix for specified logger.
 func SetPrefix(logger uint32, prefix_str string) {
-	updateLogger(logger, setPrefix, prefix_str)
+	std.SetPrefix(logger, prefix_str)
 }
 
 // Don't log, write text to standard error which will be overwritten on the next output.
@@ -318,6 +291,66 @@ func Flash(vars ...interface{}) {
 	}
 }
 
+// Sets a tag to place at the start of every log entry, such as "[svc-1]" to identify the instance in aggregated logs.
+func SetGlobalTag(tag string) {
+	std.SetGlobalTag(tag)
+}
+
+// Single character level indicators used by SetCompactLevels.
+var compact_prefix = map[uint32]string{
+	INFO:   "I ",
+	ERROR:  "E ",
+	WARN:   "W ",
+	NOTICE: "N ",
+	DEBUG:  "D ",
+	TRACE:  "T ",
+	FATAL:  "F ",
+	AUX:    "I ",
+	AUX2:   "I ",
+	AUX3:   "I ",
+	AUX4:   "I ",
+}
+
+// Replaces logger prefixes with single character level indicators, ie.. "W " rather than "[WARN] ".
+// JSON output is unaffected.
+func SetCompactLevels(enable bool) {
+	std.SetCompactLevels(enable)
+}
+
+// Sets where flash text and progress bars are written, standard error by default.
+// Flash text is only shown when w is a terminal, regardless of where log entries are written.
+func SetFlashOutput(w io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	clearFlash()
+	flash_out = w
+	piped_flash = true
+	if f, ok := w.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		piped_flash = false
+	}
+}
+
+// Truncates log entries longer than n bytes, noting how many bytes were left out. Fatal entries are never truncated.
+// Setting n to 0 disables truncation, which is the default.
+func SetMaxMessageLength(n int) {
+	std.SetMaxMessageLength(n)
+}
+
+// Sets the line ending written after each entry, such as "\r\n" for Windows log consumers. (Default "\n")
+func SetLineEnding(ending string) {
+	std.SetLineEnding(ending)
+}
+
+// Enables or disables flash and progress output, disabling clears any flash text currently displayed.
+func SetFlashEnabled(enable bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !enable {
+		clearFlash()
+	}
+	flash_disabled = !enable
+}
+
 // Don't output, but instead return a string.
 func Stringer(vars ...interface{}) string {
 	var buf bytes.Buffer
@@ -330,6 +363,21 @@ func Stdout(vars ...interface{}) {
 	write2log(_print_txt|_no_logging, vars...)
 }
 
+// Don't log, print text to standard out formatted as fmt.Print, no newline is added.
+func Print(vars ...interface{}) {
+	write2log(_print_txt|_no_logging|_raw_txt, fmt.Sprint(vars...))
+}
+
+// Don't log, print text to standard out formatted as fmt.Printf, no newline is added.
+func Printf(format string, vars ...interface{}) {
+	write2log(_print_txt|_no_logging|_raw_txt, fmt.Sprintf(format, vars...))
+}
+
+// Don't log, print text to standard out formatted as fmt.Println.
+func Println(vars ...interface{}) {
+	write2log(_print_txt|_no_logging|_raw_txt, fmt.Sprintln(vars...))
+}
+
 // Don't log, just print text to standard error.
 func Stderr(vars ...interface{}) {
 	write2log(_stderr_txt|_no_logging, vars...)
@@ -375,21 +423,74 @@ func Aux4(vars ...interface{}) {
 	write2log(AUX4, vars...)
 }
 
+// Log as Info, vars are formatted as with fmt.Sprint, so a '%' is never taken as a verb.
+func Info(vars ...interface{}) {
+	write2log(INFO, fmt.Sprint(vars...))
+}
+
+// Log as Error, vars are formatted as with fmt.Sprint, so a '%' is never taken as a verb.
+func Error(vars ...interface{}) {
+	write2log(ERROR, fmt.Sprint(vars...))
+}
+
+// Log as Info, formatted as with fmt.Sprintf.
+func Infof(format string, vars ...interface{}) {
+	write2log(INFO, fmt.Sprintf(format, vars...))
+}
+
+// Log as Error, formatted as with fmt.Sprintf.
+func Errorf(format string, vars ...interface{}) {
+	write2log(ERROR, fmt.Sprintf(format, vars...))
+}
+
+// Log as Warn, formatted as with fmt.Sprintf.
+func Warnf(format string, vars ...interface{}) {
+	write2log(WARN, fmt.Sprintf(format, vars...))
+}
+
+// Log as Debug, formatted as with fmt.Sprintf.
+func Debugf(format string, vars ...interface{}) {
+	write2log(DEBUG, fmt.Sprintf(format, vars...))
+}
+
+// Log as Fatal, formatted as with fmt.Sprintf, then quit.
+func Fatalf(format string, vars ...interface{}) {
+	std.Fatal(fmt.Sprintf(format, vars...))
+}
+
+// Log msg and err to logger, then pass err to functions registered with HookErrors.
+func LogError(logger uint32, err error, msg string) {
+	std.LogError(logger, err, msg)
+}
+
+// Registers fn to be called with each error logged through LogError.
+func HookErrors(fn func(logger uint32, err error)) {
+	std.HookErrors(fn)
+}
+
 // Log as Fatal, then quit.
 func Fatal(vars ...interface{}) {
-	if atomic.CompareAndSwapInt32(&fatal_triggered, 0, 1) {
-		// Defer fatal output, so it is the last log entry displayed.
-		write2log(FATAL|_bypass_lock, vars...)
-		signalChan <- os.Kill
-		<-exit_lock
-		os.Exit(1)
+	std.Fatal(vars...)
+}
+
+// Log as Fatal and quit if err is not nil, context is prepended to the error.
+func Must(err error, context ...string) {
+	if err == nil {
+		return
+	}
+	if len(context) > 0 {
+		Fatal("%s: %s", strings.Join(context, " "), err.Error())
 	} else {
-		// Catch any other fatals and just let them sit.
-		halt := make(chan struct{})
-		<-halt
+		Fatal(err)
 	}
 }
 
+// Returns v, or logs as Fatal and quits if err is not nil.
+func Must1[T any](v T, err error) T {
+	Must(err)
+	return v
+}
+
 // Log as Debug.
 func Debug(vars ...interface{}) {
 	write2log(DEBUG, vars...)
@@ -400,6 +501,21 @@ func Trace(vars ...interface{}) {
 	write2log(TRACE, vars...)
 }
 
+// Log to logger with text from fn, fn is only called if the logger has somewhere to write to.
+func LogLazy(logger uint32, fn func() string) {
+	std.LogLazy(logger, fn)
+}
+
+// Log as Debug with text from fn, fn is only called if debug output is enabled.
+func DebugLazy(fn func() string) {
+	std.DebugLazy(fn)
+}
+
+// Log as Trace with text from fn, fn is only called if trace output is enabled.
+func TraceLazy(fn func() string) {
+	std.TraceLazy(fn)
+}
+
 // fprintf
 func fprintf(buffer io.Writer, vars ...interface{}) {
 	vlen := len(vars)
@@ -428,135 +544,3 @@ func fprintf(buffer io.Writer, vars ...interface{}) {
 		}
 	}
 }
-
-// Prepares output text and sends to appropriate logging destinations.
-func write2log(flag uint32, vars ...interface{}) {
-
-	if atomic.LoadInt32(&fatal_triggered) == 1 {
-		if flag&_bypass_lock != 0 {
-			flag ^= _bypass_lock
-		} else {
-			return
-		}
-	}
-
-	flag = flag &^ _bypass_lock
-
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	logger := l_map[flag&^_no_logging]
-
-	var pre []byte
-
-	if flag&_no_logging != _no_logging {
-		if logger.use_ts {
-			genTS(&pre)
-		}
-		pre = append(pre, []byte(logger.prefix)[0:]...)
-	}
-
-	// Reset buffer.
-	msgBuffer.Reset()
-
-	// Create output string.
-	fprintf(&msgBuffer, vars...)
-
-	// Copy original output for export.
-	msg := msgBuffer.String()
-
-	output := msgBuffer.Bytes()
-	output = append(pre, output[0:]...)
-	bufferLen := len(output)
-
-	if bufferLen > 0 {
-		if output[len(output)-1] != '\n' && flag&_flash_txt != _flash_txt {
-			output = append(output, '\n')
-		}
-	} else if flag&_flash_txt != _flash_txt {
-		output = append(output, '\n')
-	}
-
-	// Clear out last flash text.
-	if flush_needed && !piped_stderr && ((logger.textout == os.Stdout && !piped_stdout) || logger.textout == os.Stderr) {
-		if flush_line_len < last_flash_len {
-			for i := len(flush_line); i < last_flash_len; i++ {
-				flush_line_len++
-				flush_line = append(flush_line[0:], ' ')
-			}
-
-		}
-		fmt.Fprintf(os.Stderr, "\r")
-		fmt.Fprintf(os.Stderr, "%s", string(flush_line[0:last_flash_len]))
-		fmt.Fprintf(os.Stderr, "\r")
-		flush_needed = false
-	}
-
-	last_line = bufferLen
-
-	// Flash text handler, make a line of text available to remove remnents of this text.
-	if flag&_flash_txt != 0 {
-		if !piped_stderr {
-			width := termWidth()
-			if utf8.RuneCount(output) > width {
-				output = output[0:width]
-			}
-			io.Copy(os.Stderr, bytes.NewReader(output))
-			flush_needed = true
-			last_flash_len = len(output)
-			return
-		}
-		return
-	}
-
-	io.Copy(logger.textout, bytes.NewReader(output))
-	if flag&_no_logging != 0 {
-		return
-	}
-
-	// Preprend timestamp for file.
-	if !logger.use_ts {
-		out_len := len(output)
-		genTS(&output)
-		out := output[out_len:]
-		out = append(out, output[0:out_len]...)
-		output = out
-	}
-
-	// Write to file.
-	_, err := io.Copy(logger.fileout, bytes.NewReader(output))
-	// Launch fatal in a go routine, as the mutex is currently locked.
-	if err != nil && FatalOnFileError {
-		go Fatal(err)
-	}
-
-	if export_syslog != nil && enabled_exports&flag == flag {
-		switch flag {
-		case INFO:
-			fallthrough
-		case AUX:
-			fallthrough
-		case AUX2:
-			fallthrough
-		case AUX3:
-			fallthrough
-		case AUX4:
-			err = export_syslog.Info(msg)
-		case ERROR:
-			err = export_syslog.Err(msg)
-		case WARN:
-			err = export_syslog.Warning(msg)
-		case FATAL:
-			err = export_syslog.Emerg(msg)
-		case NOTICE:
-			err = export_syslog.Notice(msg)
-		case DEBUG:
-			err = export_syslog.Debug(msg)
-		case TRACE:
-			err = export_syslog.Debug(msg)
-		}
-		if err != nil && FatalOnExportError {
-			go Fatal(err)
-		}
-	}
-}
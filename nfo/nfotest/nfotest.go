@@ -0,0 +1,49 @@
+// Package 'nfotest' sends output of package nfo to the log of a running test.
+// It is kept apart from nfo so the testing package is only linked in to test binaries.
+package nfotest
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/cmcoffee/go-snuglib/nfo"
+)
+
+// Loggers redirected by SetTestLogger.
+var loggers = []uint32{nfo.INFO, nfo.ERROR, nfo.WARN, nfo.NOTICE, nfo.DEBUG, nfo.TRACE, nfo.FATAL, nfo.AUX, nfo.AUX2, nfo.AUX3, nfo.AUX4}
+
+// Output writing each entry to the log of a test.
+type tbWriter struct {
+	tb testing.TB
+}
+
+func (w *tbWriter) Write(p []byte) (int, error) {
+	w.tb.Helper()
+	w.tb.Log(strings.TrimRight(string(p), "\r\n"))
+	return len(p), nil
+}
+
+// Sends output of the nfo package level loggers to tb.Log until the test ends, so entries are attributed to the running test.
+// Loggers without an output, such as Debug by default, remain discarded. Previous outputs are restored when tb finishes.
+// Output is process-global, so parallel tests that both call SetTestLogger will see each other's entries.
+func SetTestLogger(tb testing.TB) {
+	w := &tbWriter{tb}
+
+	saved := make(map[uint32]io.Writer)
+	for _, flag := range loggers {
+		if out := nfo.GetOutput(flag); out != nfo.None {
+			saved[flag] = out
+			nfo.SetOutput(flag, w)
+		}
+	}
+
+	tb.Cleanup(func() {
+		for flag, out := range saved {
+			// Leave alone any output changed since.
+			if nfo.GetOutput(flag) == w {
+				nfo.SetOutput(flag, out)
+			}
+		}
+	})
+}
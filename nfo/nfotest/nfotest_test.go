@@ -0,0 +1,53 @@
+package nfotest
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/cmcoffee/go-snuglib/nfo"
+)
+
+// Records what is logged to it, and runs cleanups when finished.
+type recorder struct {
+	testing.TB
+	logs     []string
+	cleanups []func()
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Log(args ...interface{}) {
+	r.logs = append(r.logs, fmt.Sprint(args...))
+}
+
+func (r *recorder) Cleanup(fn func()) {
+	r.cleanups = append(r.cleanups, fn)
+}
+
+func (r *recorder) finish() {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+}
+
+func TestSetTestLogger(t *testing.T) {
+	var out bytes.Buffer
+	nfo.SetOutput(nfo.STD, &out)
+	defer nfo.CloseLogging()
+
+	r := &recorder{TB: t}
+	SetTestLogger(r)
+	nfo.Log("to test")
+	nfo.Err("failed")
+	nfo.Debug("discarded")
+	r.finish()
+	nfo.Log("restored")
+
+	if len(r.logs) != 2 || r.logs[0] != "to test" || r.logs[1] != "[ERROR] failed" {
+		t.Errorf("test log holds %q.", r.logs)
+	}
+	if out.String() != "restored\n" {
+		t.Errorf("previous output holds %q, want only the entry after the test.", out.String())
+	}
+}
@@ -0,0 +1,41 @@
+package nfo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutputLevels(t *testing.T) {
+	defer CloseLogging()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var stdout, added bytes.Buffer
+	SetOutput(ALL, None)
+	SetOutput(AtLeast(WARN), &stdout)
+	SetFile(AtLeast(DEBUG), f)
+	AddOutput(AtLeast(DEBUG), &added)
+
+	Debug("debug entry")
+	Warn("warn entry")
+
+	if strings.Contains(stdout.String(), "debug entry") || !strings.Contains(stdout.String(), "[WARN] warn entry") {
+		t.Errorf("stdout holds %q, want only the warning.", stdout.String())
+	}
+	file, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, out := range map[string]string{"file": string(file), "AddOutput": added.String()} {
+		if !strings.Contains(out, "[DEBUG] debug entry") || !strings.Contains(out, "[WARN] warn entry") {
+			t.Errorf("%s holds %q, want both entries.", name, out)
+		}
+	}
+}
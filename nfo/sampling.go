@@ -0,0 +1,69 @@
+package nfo
+
+type sampler struct {
+	n        uint64
+	count    uint64
+	dropped  uint64
+	reported uint64
+}
+
+// Only writes every nth entry of the specified loggers, the rest are dropped and counted.
+// Each entry written after some were dropped is preceded by a line such as "99 messages dropped by sampling."
+// Setting n to 1 or less disables sampling for the loggers.
+func SetSampling(flag uint32, n int) {
+	std.SetSampling(flag, n)
+}
+
+// Returns how many entries of logger have been dropped by sampling.
+func SampledDrops(logger uint32) uint64 {
+	return std.SampledDrops(logger)
+}
+
+// Only writes every nth entry of the specified loggers, the rest are dropped and counted.
+// Each entry written after some were dropped is preceded by a line such as "99 messages dropped by sampling."
+// Setting n to 1 or less disables sampling for the loggers.
+func (L *Logger) SetSampling(flag uint32, n int) {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	if L.sampling == nil {
+		L.sampling = make(map[uint32]*sampler)
+	}
+	for k := range L.stats {
+		if flag&k != k {
+			continue
+		}
+		if n <= 1 {
+			delete(L.sampling, k)
+		} else {
+			L.sampling[k] = &sampler{n: uint64(n)}
+		}
+	}
+}
+
+// Returns how many entries of logger have been dropped by sampling.
+func (L *Logger) SampledDrops(logger uint32) uint64 {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	if s, ok := L.sampling[logger]; ok {
+		return s.dropped
+	}
+	return 0
+}
+
+// Returns false if the entry should be dropped by sampling, otherwise the number of entries dropped since the last one written.
+func (L *Logger) sample(flag uint32) (keep bool, dropped uint64) {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	s, ok := L.sampling[flag]
+	if !ok {
+		return true, 0
+	}
+	s.count++
+	if (s.count-1)%s.n == 0 {
+		dropped = s.dropped - s.reported
+		s.reported = s.dropped
+		return true, dropped
+	}
+	s.dropped++
+	return false, 0
+}
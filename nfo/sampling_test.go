@@ -0,0 +1,36 @@
+package nfo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSamplingSummary(t *testing.T) {
+	defer CloseLogging()
+
+	var buf bytes.Buffer
+	SetOutput(ALL, &buf)
+	SetSampling(DEBUG, 3)
+	ResetStats()
+
+	for i := 1; i <= 7; i++ {
+		Debug("entry %d", i)
+	}
+	Log("not sampled")
+
+	want := "[DEBUG] entry 1\n" +
+		"[DEBUG] 2 messages dropped by sampling.\n" +
+		"[DEBUG] entry 4\n" +
+		"[DEBUG] 2 messages dropped by sampling.\n" +
+		"[DEBUG] entry 7\n" +
+		"not sampled\n"
+	if got := buf.String(); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+	if got := SampledDrops(DEBUG); got != 4 {
+		t.Errorf("SampledDrops = %d, want 4.", got)
+	}
+	if got := Stats()[DEBUG]; got != 3 {
+		t.Errorf("Stats counted %d debug entries, want 3.", got)
+	}
+}
@@ -0,0 +1,94 @@
+//go:build !windows
+// +build !windows
+
+package nfo
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Run in a child process by TestShutdownDeclined, as the second signal exits the process.
+func TestShutdownDeclinedHelper(t *testing.T) {
+	if os.Getenv("NFO_DECLINE_HELPER") == "" {
+		t.Skip("run by TestShutdownDeclined")
+	}
+	SetOutput(ALL, os.Stdout)
+
+	var count int32
+	declined := make(chan struct{}, 1)
+	SignalCallback(syscall.SIGINT, func() bool { return atomic.AddInt32(&count, 1) > 1 })
+	OnShutdownDeclined(func(s os.Signal) {
+		Log("declined %s", s)
+		declined <- struct{}{}
+	})
+	Defer(func() { Log("deferred") })
+
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+	select {
+	case <-declined:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first signal was not declined.")
+	}
+	Log("running")
+
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+	time.Sleep(5 * time.Second)
+	t.Fatal("second signal did not exit.")
+}
+
+func TestShutdownDeclined(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestShutdownDeclinedHelper$")
+	cmd.Env = append(os.Environ(), "NFO_DECLINE_HELPER=1")
+	out, err := cmd.CombinedOutput()
+
+	var exit_err *exec.ExitError
+	if !errors.As(err, &exit_err) || exit_err.ExitCode() != 130 {
+		t.Fatalf("helper exited with %v, want exit code 130:\n%s", err, out)
+	}
+	want := "declined interrupt\nrunning\ndeferred\n"
+	if !strings.Contains(string(out), want) {
+		t.Errorf("helper output:\n%s\nwant it to contain:\n%s", out, want)
+	}
+}
+
+// Run in a child process by TestLazySignals, which expects SIGINT to end it.
+func TestLazySignalsHelper(t *testing.T) {
+	if os.Getenv("NFO_LAZY_HELPER") == "" {
+		t.Skip("run by TestLazySignals")
+	}
+	dir := t.TempDir()
+	if _, err := LogFile(filepath.Join(dir, "test.log"), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetAuditLog(filepath.Join(dir, "audit.log"), ERROR); err != nil {
+		t.Fatal(err)
+	}
+	SetFlushInterval(time.Minute)
+	StartHeartbeat(time.Minute)
+
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+	time.Sleep(5 * time.Second)
+	t.Fatal("SIGINT was captured.")
+}
+
+func TestLazySignals(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLazySignalsHelper$")
+	cmd.Env = append(os.Environ(), "NFO_LAZY_HELPER=1")
+	out, err := cmd.CombinedOutput()
+
+	var exit_err *exec.ExitError
+	if !errors.As(err, &exit_err) {
+		t.Fatalf("helper returned %v:\n%s", err, out)
+	}
+	if ws, ok := exit_err.Sys().(syscall.WaitStatus); !ok || !ws.Signaled() || ws.Signal() != syscall.SIGINT {
+		t.Errorf("helper exited with %v, want it killed by SIGINT:\n%s", err, out)
+	}
+}
@@ -0,0 +1,69 @@
+package nfo
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Number of frames included in a stack trace added by SetStackTrace.
+const stack_depth = 8
+
+// Loggers that have a stack trace added to their entries.
+var stack_levels uint32
+
+// Frames skipped beyond those within nfo, for wrappers around the logging functions.
+var caller_skip int
+
+// Adds a short stack trace of the caller to entries logged at min or greater severity, ie.. SetStackTrace(WARN).
+// Frames within nfo are skipped and the trace is limited to a few frames, it is left out of formatted outputs and syslog.
+// Setting min to 0 disables stack traces.
+func SetStackTrace(min uint32) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	stack_levels = AtLeast(min)
+}
+
+// Skips n more frames when reporting the caller, so a stack trace starts at the real call site rather than within a
+// wrapper around nfo, ie.. SetCallerSkip(1) for a mylog.Error that calls nfo.Err.
+func SetCallerSkip(n int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	caller_skip = n
+}
+
+// Returns the stack trace of the caller logging the entry, each frame on its own line, mutex must be held by caller.
+func callerStack(line_ending string) []byte {
+	pc := make([]uintptr, 32)
+	pc = pc[:runtime.Callers(1, pc)]
+	frames := runtime.CallersFrames(pc)
+
+	var (
+		out  []byte
+		self string
+		n    int
+		skip = caller_skip
+	)
+
+	for {
+		f, more := frames.Next()
+		// The first frame is this function, which gives us the package to skip.
+		if self == "" {
+			self = f.Function[:strings.LastIndex(f.Function, ".")+1]
+		} else if !strings.HasPrefix(f.Function, self) {
+			if strings.HasPrefix(f.Function, "runtime.") || n == stack_depth {
+				break
+			}
+			if skip > 0 {
+				skip--
+			} else {
+				out = append(out, fmt.Sprintf("%s\t%s (%s:%d)", line_ending, f.Function, f.File, f.Line)...)
+				n++
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return out
+}
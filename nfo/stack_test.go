@@ -0,0 +1,44 @@
+// Kept outside package nfo, as frames within nfo are left out of stack traces.
+package nfo_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/cmcoffee/go-snuglib/nfo"
+)
+
+// Wrapper as an application would write around nfo.
+func logError(msg string) {
+	nfo.Err(msg)
+}
+
+func TestSetCallerSkip(t *testing.T) {
+	defer nfo.CloseLogging()
+
+	var buf bytes.Buffer
+	nfo.SetOutput(nfo.ALL, &buf)
+	nfo.SetStackTrace(nfo.ERROR)
+
+	logError("without skip")
+	if first := firstFrame(buf.String()); !strings.Contains(first, "nfo_test.logError") {
+		t.Errorf("trace starts at %q, want the wrapper.", first)
+	}
+
+	buf.Reset()
+	nfo.SetCallerSkip(1)
+	logError("with skip")
+	if first := firstFrame(buf.String()); !strings.Contains(first, "nfo_test.TestSetCallerSkip") {
+		t.Errorf("trace starts at %q, want the caller of the wrapper.", first)
+	}
+}
+
+// Returns the first frame of the stack trace in entry.
+func firstFrame(entry string) string {
+	lines := strings.Split(entry, "\n")
+	if len(lines) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(lines[1])
+}
@@ -0,0 +1,57 @@
+package nfo
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Program details recorded by LogStartup.
+type StartupInfo struct {
+	Name    string
+	Version string
+	PID     int
+	Started time.Time
+}
+
+var startup struct {
+	mutex sync.Mutex
+	info  *StartupInfo
+}
+
+// Logs the program name, version and PID, and records them for GetStartupInfo.
+// Once recorded, the uptime and exit code are logged when the application shuts down.
+func LogStartup(name, version string) {
+	info := &StartupInfo{
+		Name:    name,
+		Version: version,
+		PID:     os.Getpid(),
+		Started: time.Now(),
+	}
+
+	startup.mutex.Lock()
+	startup.info = info
+	startup.mutex.Unlock()
+
+	Log("Starting %s %s (pid %d).", info.Name, info.Version, info.PID)
+}
+
+// Returns details recorded by LogStartup, false if LogStartup has not been called.
+func GetStartupInfo() (StartupInfo, bool) {
+	startup.mutex.Lock()
+	defer startup.mutex.Unlock()
+	if startup.info == nil {
+		return StartupInfo{}, false
+	}
+	return *startup.info, true
+}
+
+// Logs uptime and exit code on shutdown, if LogStartup was called.
+func logShutdown(exit_code int) {
+	info, ok := GetStartupInfo()
+	if !ok {
+		return
+	}
+	uptime := time.Since(info.Started).Round(time.Second)
+	write2log(INFO|_bypass_lock, "Stopping %s %s after %s, exit code %d.", info.Name, info.Version, uptime, exit_code)
+}
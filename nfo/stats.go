@@ -0,0 +1,97 @@
+package nfo
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Returns a per level count of log entries written, the map is fixed once created so counts can be updated without a lock.
+func newStats() map[uint32]*uint64 {
+	return map[uint32]*uint64{
+		INFO:   new(uint64),
+		ERROR:  new(uint64),
+		WARN:   new(uint64),
+		NOTICE: new(uint64),
+		DEBUG:  new(uint64),
+		TRACE:  new(uint64),
+		FATAL:  new(uint64),
+		AUX:    new(uint64),
+		AUX2:   new(uint64),
+		AUX3:   new(uint64),
+		AUX4:   new(uint64),
+	}
+}
+
+// Count of panics recovered by SafeGo.
+var recovered_panics uint64
+
+// Adds to count of logger.
+func (L *Logger) countLog(flag uint32) {
+	if c, ok := L.stats[flag]; ok {
+		atomic.AddUint64(c, 1)
+	}
+}
+
+// Returns a snapshot of how many entries have been logged per logger, since start or last ResetStats.
+func Stats() map[uint32]uint64 {
+	return std.Stats()
+}
+
+// Returns a snapshot of how many entries have been logged per logger, since start or last ResetStats.
+func (L *Logger) Stats() map[uint32]uint64 {
+	out := make(map[uint32]uint64, len(L.stats))
+	for k, v := range L.stats {
+		out[k] = atomic.LoadUint64(v)
+	}
+	return out
+}
+
+// Returns how many panics have been recovered by SafeGo, since start or last ResetStats.
+func RecoveredPanics() uint64 {
+	return atomic.LoadUint64(&recovered_panics)
+}
+
+// Resets all logger counts of the default Logger and the recovered panic count to zero.
+func ResetStats() {
+	std.ResetStats()
+	atomic.StoreUint64(&recovered_panics, 0)
+}
+
+// Resets all logger counts to zero.
+func (L *Logger) ResetStats() {
+	for _, v := range L.stats {
+		atomic.StoreUint64(v, 0)
+	}
+}
+
+// Logger the exit summary is written to, 0 when disabled.
+var exit_summary uint32
+
+// Logs a summary of error and warning counts of the default Logger at shutdown, such as "Completed with 3 errors, 12 warnings.", as Info unless another logger is specified.
+func SetExitSummary(enable bool, logger ...uint32) {
+	flag := uint32(INFO)
+	if len(logger) > 0 {
+		flag = logger[0]
+	}
+	if !enable {
+		flag = 0
+	}
+	atomic.StoreUint32(&exit_summary, flag)
+}
+
+// Writes the exit summary, if enabled.
+func logExitSummary() {
+	flag := atomic.LoadUint32(&exit_summary)
+	if flag == 0 {
+		return
+	}
+	plural := func(n uint64, name string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, name)
+		}
+		return fmt.Sprintf("%d %ss", n, name)
+	}
+	errors := atomic.LoadUint64(std.stats[ERROR]) + atomic.LoadUint64(std.stats[FATAL])
+	warnings := atomic.LoadUint64(std.stats[WARN])
+	write2log(flag|_bypass_lock, "Completed with %s, %s.", plural(errors, "error"), plural(warnings, "warning"))
+}
@@ -0,0 +1,67 @@
+package nfo
+
+import (
+	"strings"
+	"sync"
+)
+
+// Number of lines held for a subscriber before further lines are dropped.
+const subscribe_buffer = 256
+
+// Output handing lines to a subscriber, lines are dropped rather than blocking when the subscriber falls behind.
+type chanWriter struct {
+	mutex  sync.Mutex
+	ch     chan string
+	closed bool
+}
+
+func (c *chanWriter) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.closed {
+		select {
+		case c.ch <- strings.TrimRight(string(p), "\r\n"):
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// Returns a channel receiving each entry logged at min or greater severity, as written to log files, along with a function to unsubscribe.
+// Entries are dropped when the channel is full, so a slow reader never holds up logging.
+func SubscribeLevel(min uint32) (<-chan string, func()) {
+	return std.Subscribe(AtLeast(min))
+}
+
+// Returns a channel receiving each entry of the specified loggers, as written to log files, along with a function to unsubscribe.
+// Entries are dropped when the channel is full, so a slow reader never holds up logging.
+func (L *Logger) Subscribe(flag uint32) (<-chan string, func()) {
+	c := &chanWriter{ch: make(chan string, subscribe_buffer)}
+	L.AddOutput(flag, c)
+
+	var once sync.Once
+	return c.ch, func() {
+		once.Do(func() {
+			L.removeOutput(c)
+			c.mutex.Lock()
+			c.closed = true
+			close(c.ch)
+			c.mutex.Unlock()
+		})
+	}
+}
+
+// Removes subscriber c from the additional outputs of all loggers.
+func (L *Logger) removeOutput(c *chanWriter) {
+	L.mutex.Lock()
+	defer L.mutex.Unlock()
+	for _, l := range L.l_map {
+		var outputs []extOutput
+		for _, o := range l.outputs {
+			if w, ok := o.w.(*chanWriter); !ok || w != c {
+				outputs = append(outputs, o)
+			}
+		}
+		l.outputs = outputs
+	}
+}
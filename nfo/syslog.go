@@ -1,7 +1,5 @@
 package nfo
 
-var export_syslog SyslogWriter
-
 // Interface for log/syslog/Writer.
 type SyslogWriter interface {
 	Alert(string) error
@@ -16,14 +14,10 @@ type SyslogWriter interface {
 
 // Send messages to syslog
 func HookSyslog(syslog_writer SyslogWriter) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	export_syslog = syslog_writer
+	std.HookSyslog(syslog_writer)
 }
 
 // Disconnect form syslog
 func UnhookSyslog() {
-	mutex.Lock()
-	defer mutex.Unlock()
-	export_syslog = nil
+	std.UnhookSyslog()
 }
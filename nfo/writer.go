@@ -0,0 +1,46 @@
+package nfo
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Writer logging each line written to it.
+type levelWriter struct {
+	mutex  sync.Mutex
+	logger *Logger
+	flag   uint32
+	buf    []byte
+}
+
+func (W *levelWriter) Write(p []byte) (int, error) {
+	W.mutex.Lock()
+	defer W.mutex.Unlock()
+
+	W.buf = append(W.buf, p...)
+	for {
+		n := bytes.IndexByte(W.buf, '\n')
+		if n < 0 {
+			break
+		}
+		W.logger.write(W.flag, string(bytes.TrimSuffix(W.buf[:n], []byte{'\r'})))
+		W.buf = W.buf[n+1:]
+	}
+	if len(W.buf) == 0 {
+		W.buf = nil
+	}
+	return len(p), nil
+}
+
+// Returns an io.Writer logging each line written to it to logger, for handing to libraries that write their own output.
+// Each writer returned is independent, and holds on to a partial line until its newline is written.
+func (L *Logger) LevelWriter(logger uint32) io.Writer {
+	return &levelWriter{logger: L, flag: logger}
+}
+
+// Returns an io.Writer logging each line written to it to logger, for handing to libraries that write their own output.
+// Each writer returned is independent, and holds on to a partial line until its newline is written.
+func LevelWriter(logger uint32) io.Writer {
+	return std.LevelWriter(logger)
+}